@@ -0,0 +1,318 @@
+// Command persistent operates on the directory of a persistent store.
+//
+// Usage:
+//
+//	persistent export -dir DIR [-partition PATH]... [-format json|ndjson] [PATH]
+//	persistent import -dir DIR [-partition PATH]... FILE|DIRECTORY
+//	persistent backup -dir DIR [-partition PATH]... [-since VERSION] FILE
+//	persistent restore -dir DIR [-partition PATH]... FILE
+//	persistent rotate-key -dir DIR (-key-file FILE | -key-env VAR) (-new-key-file FILE | -new-key-env VAR)
+//	persistent upgrade -dir DIR [-partition PATH]... SRC
+//
+// The partitions must match the partitions that the store was written with.
+// Encrypted stores are opened with the key given by -key-file or -key-env.
+// Key files contain the raw key and key environment variables contain the
+// hex-encoded key.
+// The upgrade command copies a store written by a version built on badger
+// v1.6 from SRC into a new store in DIR.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/tsandall/opa-persistent-store-exp/persistent"
+)
+
+var commands = map[string]func(args []string) error{
+	"backup":     runBackup,
+	"export":     runExport,
+	"import":     runImport,
+	"restore":    runRestore,
+	"rotate-key": runRotateKey,
+	"upgrade":    runUpgrade,
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprintf(os.Stderr, "usage: %v <command> [flags]\n\ncommands:\n", os.Args[0])
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %v\n", name)
+		}
+		os.Exit(2)
+	}
+	if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runExport(args []string) error {
+
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var opts storeFlags
+	opts.register(fs)
+	format := fs.String("format", "json", "output format (json or ndjson)")
+	fs.Parse(args)
+
+	path := storage.Path{}
+	if fs.NArg() > 0 {
+		var ok bool
+		path, ok = storage.ParsePathEscaped(fs.Arg(0))
+		if !ok {
+			return fmt.Errorf("invalid path: %v", fs.Arg(0))
+		}
+	}
+
+	var export func(context.Context, *persistent.Store, storage.Path) error
+
+	switch *format {
+	case "json":
+		export = func(ctx context.Context, s *persistent.Store, path storage.Path) error {
+			if err := s.ExportJSON(ctx, os.Stdout, path); err != nil {
+				return err
+			}
+			_, err := fmt.Println()
+			return err
+		}
+	case "ndjson":
+		export = func(ctx context.Context, s *persistent.Store, path storage.Path) error {
+			return s.ExportNDJSON(ctx, os.Stdout, path)
+		}
+	default:
+		return fmt.Errorf("unknown format: %v", *format)
+	}
+
+	s, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return export(context.Background(), s, path)
+}
+
+func runImport(args []string) error {
+
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var opts storeFlags
+	opts.register(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected one file or directory to import")
+	}
+
+	s, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	_, err = s.Import(context.Background(), fs.Arg(0), persistent.ImportOptions{
+		Progress: func(stats persistent.ImportStats) {
+			fmt.Fprintf(os.Stderr, "imported %d files (%d bytes) in %v\n", stats.Files, stats.Bytes, stats.Elapsed)
+		},
+	})
+
+	return err
+}
+
+func runBackup(args []string) error {
+
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	var opts storeFlags
+	opts.register(fs)
+	since := fs.Uint64("since", 0, "only back up changes at or after this version")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected backup file")
+	}
+
+	s, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	f, err := os.Create(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	next, err := s.Backup(f, *since)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "backup complete, use -since %d for the next incremental backup\n", next)
+	return nil
+}
+
+func runRestore(args []string) error {
+
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	var opts storeFlags
+	opts.register(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected backup file")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	return s.Restore(f)
+}
+
+func runRotateKey(args []string) error {
+
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	dir := fs.String("dir", "", "store directory")
+	var oldKey, newKey keyFlags
+	oldKey.register(fs, "")
+	newKey.register(fs, "new-")
+	fs.Parse(args)
+
+	if *dir == "" {
+		return fmt.Errorf("-dir must be set")
+	}
+
+	old, err := oldKey.key()
+	if err != nil {
+		return err
+	}
+
+	key, err := newKey.key()
+	if err != nil {
+		return err
+	} else if key == nil {
+		return fmt.Errorf("-new-key-file or -new-key-env must be set")
+	}
+
+	return persistent.RotateEncryptionKey(*dir, old, key)
+}
+
+func runUpgrade(args []string) error {
+
+	fs := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	var opts storeFlags
+	opts.register(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected source directory")
+	}
+
+	popts, err := opts.options()
+	if err != nil {
+		return err
+	}
+
+	return persistent.Upgrade(fs.Arg(0), popts)
+}
+
+// storeFlags contains the flags used to open a store.
+type storeFlags struct {
+	dir        string
+	partitions pathsFlag
+	keyFlags
+}
+
+func (f *storeFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.dir, "dir", "", "store directory")
+	fs.Var(&f.partitions, "partition", "partition path (repeatable)")
+	f.keyFlags.register(fs, "")
+}
+
+func (f *storeFlags) open() (*persistent.Store, error) {
+	opts, err := f.options()
+	if err != nil {
+		return nil, err
+	}
+	return persistent.New(opts)
+}
+
+func (f *storeFlags) options() (persistent.Options, error) {
+	if f.dir == "" {
+		return persistent.Options{}, fmt.Errorf("-dir must be set")
+	}
+	key, err := f.key()
+	if err != nil {
+		return persistent.Options{}, err
+	}
+	return persistent.Options{
+		Dir:           f.dir,
+		Partitions:    f.partitions,
+		EncryptionKey: key,
+	}, nil
+}
+
+// keyFlags contains the flags that select an encryption key.
+type keyFlags struct {
+	file string
+	env  string
+}
+
+func (f *keyFlags) register(fs *flag.FlagSet, prefix string) {
+	fs.StringVar(&f.file, prefix+"key-file", "", "file containing the "+prefix+"encryption key")
+	fs.StringVar(&f.env, prefix+"key-env", "", "environment variable containing the hex-encoded "+prefix+"encryption key")
+}
+
+// key returns the selected encryption key or nil if no key is selected.
+func (f *keyFlags) key() ([]byte, error) {
+	switch {
+	case f.file != "" && f.env != "":
+		return nil, fmt.Errorf("only one of key file and key environment variable can be set")
+	case f.file != "":
+		return persistent.EncryptionKeyFromFile(f.file)
+	case f.env != "":
+		return persistent.EncryptionKeyFromEnv(f.env)
+	}
+	return nil, nil
+}
+
+type pathsFlag []storage.Path
+
+func (f *pathsFlag) String() string {
+	strs := make([]string, len(*f))
+	for i := range *f {
+		strs[i] = (*f)[i].String()
+	}
+	return strings.Join(strs, ",")
+}
+
+func (f *pathsFlag) Set(s string) error {
+	path, ok := storage.ParsePathEscaped(s)
+	if !ok {
+		return fmt.Errorf("invalid path: %v", s)
+	}
+	*f = append(*f, path)
+	return nil
+}
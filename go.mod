@@ -4,6 +4,8 @@ go 1.15
 
 require (
 	github.com/dgraph-io/badger v1.6.2
-	github.com/dgraph-io/badger/v3 v3.2011.1 // indirect
+	github.com/dgraph-io/badger/v2 v2.2007.4
+	github.com/dgraph-io/ristretto v0.0.4-0.20210122082011-bb5d392ed82d // indirect
+	github.com/fxamacker/cbor/v2 v2.5.0
 	github.com/open-policy-agent/opa v0.26.0
 )
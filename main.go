@@ -5,6 +5,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"runtime"
@@ -77,14 +78,18 @@ func getPersistentKube(ctx context.Context, numNamespaces, numIngresses int) sto
 		check(err)
 	}
 
-	store := persistent.New(dir, []storage.Path{
-		storage.MustParsePath("/kubernetes/ingresses"),
-		storage.MustParsePath("/bundles"),
-		storage.MustParsePath("/system"),
+	store, err := persistent.New(persistent.Options{
+		Dir: dir,
+		Partitions: []storage.Path{
+			storage.MustParsePath("/kubernetes/ingresses/*"),
+			storage.MustParsePath("/bundles"),
+			storage.MustParsePath("/system"),
+		},
 	})
+	check(err)
 
 	if *pump {
-		txn, err := store.NewTransaction(ctx, storage.WriteParams)
+		txn, err := store.NewLoadTransaction(ctx)
 		check(err)
 
 		err = store.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/kubernetes/ingresses"), map[string]interface{}{})
@@ -98,14 +103,6 @@ func getPersistentKube(ctx context.Context, numNamespaces, numIngresses int) sto
 					err = store.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/kubernetes/ingresses/"+ns), map[string]interface{}{})
 					check(err)
 				}
-				n := (i * numIngresses) + j
-				if n%100 == 0 {
-					fmt.Println("committing", n)
-					err = store.Commit(ctx, txn)
-					check(err)
-					txn, err = store.NewTransaction(ctx, storage.WriteParams)
-					check(err)
-				}
 				obj := exampleK8sIngress
 				err = store.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/kubernetes/ingresses/"+ns+"/"+name), obj)
 				check(err)
@@ -174,12 +171,17 @@ func getPersistentRBAC(ctx context.Context, numUsers int) storage.Store {
 		check(err)
 	}
 
-	store := persistent.New(dir, []storage.Path{
-		{"bundles"},
-		{"user_roles"},
-		{"role_grants"},
-		{"system"},
+	store, err := persistent.New(persistent.Options{
+		Dir: dir,
+		Partitions: []storage.Path{
+			{"bundles"},
+			{"user_roles"},
+			{"role_grants"},
+			{"system"},
+		},
+		CacheSize: 1000,
 	})
+	check(err)
 
 	if *pump {
 
@@ -238,30 +240,29 @@ func getPersistentRBAC(ctx context.Context, numUsers int) storage.Store {
 		err = store.Write(ctx, txn, storage.AddOp, storage.Path{"role_grants"}, roleGrants)
 		check(err)
 
-		userRoles := []interface{}{"employee", "billing"}
-		err = store.Write(ctx, txn, storage.AddOp, storage.Path{"user_roles"}, map[string]interface{}{})
-		check(err)
-
-		for i := 0; i < numUsers; i++ {
-			if i%100000 == 0 {
-				fmt.Println("committing", i)
-				err = store.Commit(ctx, txn)
-				check(err)
-				txn, err = store.NewTransaction(ctx, storage.WriteParams)
-				check(err)
-			}
-
-			userName := fmt.Sprintf("alice%d", i)
-			err = store.Write(ctx, txn, storage.AddOp, storage.Path{"user_roles", userName}, userRoles)
-			check(err)
-		}
-
 		err = store.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/bundles/11111111111111111111"), map[string]interface{}{
 			"revision": strings.Repeat("X", 1024),
 		})
 
 		err = store.Commit(ctx, txn)
 		check(err)
+
+		userRoles := []interface{}{"employee", "billing"}
+		i := 0
+
+		_, err = store.BulkLoad(ctx, func() (storage.Path, interface{}, error) {
+			if i == numUsers {
+				return nil, nil, io.EOF
+			}
+			userName := fmt.Sprintf("alice%d", i)
+			i++
+			return storage.Path{"user_roles", userName}, userRoles, nil
+		}, persistent.BulkLoadOptions{
+			Progress: func(stats persistent.BulkLoadStats) {
+				fmt.Printf("loaded %d keys (%.0f keys/sec)\n", stats.Keys, stats.Rate())
+			},
+		})
+		check(err)
 	}
 
 	return store
@@ -387,25 +388,20 @@ func getPersistentTenant(ctx context.Context) storage.Store {
 		check(err)
 	}
 
-	store := persistent.New(dir, []storage.Path{
-		{"tenants"},
-		{"system"},
+	store, err := persistent.New(persistent.Options{
+		Dir: dir,
+		Partitions: []storage.Path{
+			{"tenants"},
+			{"system"},
+		},
 	})
-
-	var err error
+	check(err)
 
 	if *pump {
-		var txn storage.Transaction
+		txn, err := store.NewLoadTransaction(ctx)
+		check(err)
+
 		for i := 0; i < 1000*1000*10; i++ {
-			if i%100000 == 0 {
-				if txn != nil {
-					fmt.Println("commiting", i)
-					err = store.Commit(ctx, txn)
-					check(err)
-				}
-				txn, err = store.NewTransaction(ctx, storage.WriteParams)
-				check(err)
-			}
 			err = store.Write(ctx, txn, storage.AddOp, storage.MustParsePath(fmt.Sprintf("/tenants/t%d", i)), map[string]interface{}{
 				"operations": []interface{}{
 					"op1",
@@ -413,11 +409,9 @@ func getPersistentTenant(ctx context.Context) storage.Store {
 			})
 			check(err)
 		}
-		if txn != nil {
-			fmt.Println("commiting last batch")
-			err = store.Commit(ctx, txn)
-			check(err)
-		}
+
+		err = store.Commit(ctx, txn)
+		check(err)
 	}
 
 	return store
@@ -0,0 +1,192 @@
+package persistent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/open-policy-agent/opa/storage"
+)
+
+// maxPendingRestoreWrites is the number of pending writes that badger buffers
+// while restoring.
+const maxPendingRestoreWrites = 256
+
+// backupHeader precedes the badger backup stream. It records the store
+// parameters that a backup can only be restored with.
+type backupHeader struct {
+	FormatVersion int      `json:"format_version"`
+	Codec         string   `json:"codec"`
+	Partitions    []string `json:"partitions"`
+	Since         uint64   `json:"since"`
+}
+
+// Backup writes the keys that changed at or after version since to w. If
+// since is zero, the entire store is written. Backup returns the version to
+// pass as since for the next incremental backup. Backups are taken from a
+// snapshot so transactions can continue while the backup runs.
+//
+// The backup includes the store's format version, codec and partitions and
+// can only be restored into a store with the same parameters. Backups of
+// encrypted stores are not encrypted.
+func (s *Store) Backup(w io.Writer, since uint64) (uint64, error) {
+
+	if _, err := s.acquire(); err != nil {
+		return 0, err
+	}
+
+	defer s.active.Done()
+
+	header := backupHeader{
+		FormatVersion: formatVersion,
+		Codec:         s.codec.Name(),
+		Partitions:    partitionStrings(s.partitions),
+		Since:         since,
+	}
+
+	bs, err := json.Marshal(header)
+	if err != nil {
+		return 0, wrapError(err)
+	}
+
+	if _, err := w.Write(append(bs, '\n')); err != nil {
+		return 0, wrapError(err)
+	}
+
+	version, err := s.db.Backup(w, since)
+	if err != nil {
+		return 0, wrapError(err)
+	}
+
+	if version < since {
+		return since, nil
+	}
+
+	return version + 1, nil
+}
+
+// Restore loads a backup written by Backup into the store. Transactions are
+// rejected while the restore runs and Restore waits for in-flight
+// transactions to finish before loading the backup.
+//
+// Restored keys keep the versions they had when they were backed up. A full
+// backup should be restored into an empty store and incremental backups
+// should be restored in the order they were taken, without writing to the
+// store in between. If the store does not contain any data, it adopts the
+// codec of the backup.
+func (s *Store) Restore(r io.Reader) error {
+
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errClosed
+	}
+	s.restoring = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.restoring = false
+		s.mu.Unlock()
+	}()
+
+	s.active.Wait()
+
+	br := bufio.NewReader(r)
+
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return errInvalidBackup(err.Error())
+	}
+
+	var header backupHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return errInvalidBackup(err.Error())
+	}
+
+	if err := s.checkBackupHeader(header); err != nil {
+		return err
+	}
+
+	if header.Codec != s.codec.Name() {
+		if err := s.adoptCodec(header.Codec); err != nil {
+			return err
+		}
+	}
+
+	if s.cache != nil {
+		defer s.cache.reset()
+	}
+
+	return wrapError(s.db.Load(br, maxPendingRestoreWrites))
+}
+
+func (s *Store) checkBackupHeader(header backupHeader) error {
+
+	if header.FormatVersion != formatVersion {
+		return errInvalidBackup(fmt.Sprintf("unsupported format version %d", header.FormatVersion))
+	}
+
+	exp := partitionStrings(s.partitions)
+	sort.Strings(exp)
+	sort.Strings(header.Partitions)
+
+	if !stringsEqual(exp, header.Partitions) {
+		return errInvalidBackup(fmt.Sprintf("backup partitions %v do not match store partitions %v", header.Partitions, exp))
+	}
+
+	return nil
+}
+
+// adoptCodec switches the store to the codec of a backup. The codec can only
+// be changed while the store does not contain any data.
+func (s *Store) adoptCodec(name string) error {
+
+	codec, ok := codecs[name]
+	if !ok {
+		return errInvalidBackup(fmt.Sprintf("unknown codec %q", name))
+	}
+
+	empty, err := s.empty()
+	if err != nil {
+		return wrapError(err)
+	} else if !empty {
+		return errInvalidBackup(fmt.Sprintf("backup codec %q does not match store codec %q", name, s.codec.Name()))
+	}
+
+	if err := s.putMetadata(codecKey, name); err != nil {
+		return wrapError(err)
+	}
+
+	s.codec = codec
+	return nil
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func partitionStrings(partitions []storage.Path) []string {
+	strs := make([]string, len(partitions))
+	for i := range partitions {
+		strs[i] = partitions[i].String()
+	}
+	return strs
+}
+
+func errInvalidBackup(msg string) *storage.Error {
+	return &storage.Error{Code: storage.InternalErr, Message: fmt.Sprintf("invalid backup: %v", msg)}
+}
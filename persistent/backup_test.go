@@ -0,0 +1,204 @@
+package persistent
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util"
+	"github.com/open-policy-agent/opa/util/test"
+)
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	partitions := []storage.Path{{"users"}, {"groups", "*"}}
+
+	src := newInMemoryStore(t, partitions)
+	defer src.Close()
+
+	err := storage.WriteOne(ctx, src, storage.AddOp, storage.Path{}, util.MustUnmarshalJSON([]byte(`{
+		"users": {"alice": "a", "bob": "b"},
+		"groups": {"eng": {"x": 1}},
+		"other": {"y": 2}
+	}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var full bytes.Buffer
+	since, err := src.Backup(&full, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp1, err := storage.ReadOne(ctx, src, storage.Path{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.Txn(ctx, src, storage.WriteParams, func(txn storage.Transaction) error {
+		if err := src.Write(ctx, txn, storage.RemoveOp, storage.MustParsePath("/users/bob"), nil); err != nil {
+			return err
+		}
+		return src.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/groups/eng/z"), 3)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var incremental bytes.Buffer
+	if _, err := src.Backup(&incremental, since); err != nil {
+		t.Fatal(err)
+	}
+
+	exp2, err := storage.ReadOne(ctx, src, storage.Path{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(Options{InMemory: true, Partitions: partitions, CacheSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i, tc := range []struct {
+		backup *bytes.Buffer
+		exp    interface{}
+	}{
+		{&full, exp1},
+		{&incremental, exp2},
+	} {
+		if err := s.Restore(tc.backup); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		result, err := storage.ReadOne(ctx, s, storage.Path{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tc.exp, result) {
+			t.Fatalf("%d: expected %v but got %v", i, tc.exp, result)
+		}
+	}
+
+	// Transactions are accepted again after restoring.
+
+	if err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/users/carol"), "c"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreErrors(t *testing.T) {
+	test.WithTempFS(map[string]string{}, func(dir string) {
+		src := newTestStore(t, filepath.Join(dir, "src"), []storage.Path{{"users"}})
+		defer src.Close()
+
+		var buf bytes.Buffer
+		if _, err := src.Backup(&buf, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		backup := buf.String()
+		ctx := context.Background()
+
+		tests := []struct {
+			note   string
+			opts   Options
+			data   map[string]interface{}
+			backup string
+			exp    string
+		}{
+			{
+				note:   "garbage",
+				opts:   Options{Partitions: []storage.Path{{"users"}}},
+				backup: "garbage",
+				exp:    "invalid backup",
+			},
+			{
+				note:   "partitions",
+				opts:   Options{Partitions: []storage.Path{{"groups"}}},
+				backup: backup,
+				exp:    "backup partitions [/users] do not match store partitions [/groups]",
+			},
+			{
+				note:   "codec",
+				opts:   Options{Partitions: []storage.Path{{"users"}}, Codec: CBOR},
+				data:   map[string]interface{}{"users": map[string]interface{}{"alice": "a"}},
+				backup: backup,
+				exp:    `backup codec "json" does not match store codec "cbor"`,
+			},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.note, func(t *testing.T) {
+				tc.opts.Dir = filepath.Join(dir, tc.note)
+				s, err := New(tc.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.Close()
+				if tc.data != nil {
+					if err := storage.WriteOne(ctx, s, storage.AddOp, storage.Path{}, tc.data); err != nil {
+						t.Fatal(err)
+					}
+				}
+				err = s.Restore(strings.NewReader(tc.backup))
+				if err == nil || !strings.Contains(err.Error(), tc.exp) {
+					t.Fatalf("expected error containing %q but got: %v", tc.exp, err)
+				}
+			})
+		}
+	})
+}
+
+func TestRestoreAdoptsCodec(t *testing.T) {
+	test.WithTempFS(map[string]string{}, func(dir string) {
+		ctx := context.Background()
+		partitions := []storage.Path{{"users"}}
+
+		src, err := New(Options{Dir: filepath.Join(dir, "src"), Partitions: partitions, Codec: CBOR})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+
+		if err := storage.WriteOne(ctx, src, storage.AddOp, storage.MustParsePath("/users/alice"), "a"); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if _, err := src.Backup(&buf, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		// The destination is initialized with the default codec.
+
+		dst := newTestStore(t, filepath.Join(dir, "dst"), partitions)
+
+		if err := dst.Restore(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := dst.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		dst = newTestStore(t, filepath.Join(dir, "dst"), partitions)
+		defer dst.Close()
+
+		if dst.codec != CBOR {
+			t.Fatalf("expected cbor codec but got %v", dst.codec.Name())
+		}
+
+		val, err := storage.ReadOne(ctx, dst, storage.MustParsePath("/users/alice"))
+		if err != nil {
+			t.Fatal(err)
+		} else if val != "a" {
+			t.Fatalf("expected a but got %v", val)
+		}
+	})
+}
@@ -0,0 +1,185 @@
+package persistent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util"
+)
+
+const defaultProgressInterval = time.Second
+
+// DocumentIterator returns the next document to load and its path. It
+// returns io.EOF when there are no more documents.
+type DocumentIterator func() (storage.Path, interface{}, error)
+
+// NewNDJSONIterator returns an iterator over the documents in r. Each
+// document is a JSON object with a "path" string and a "value", e.g.,
+// {"path": "/users/alice", "value": {"roles": ["admin"]}}. Path segments are
+// URL-escaped like storage.Path.String. Documents are typically separated by
+// newlines.
+func NewNDJSONIterator(r io.Reader) DocumentIterator {
+	decoder := util.NewJSONDecoder(r)
+	return func() (storage.Path, interface{}, error) {
+		var doc struct {
+			Path  *string     `json:"path"`
+			Value interface{} `json:"value"`
+		}
+		if err := decoder.Decode(&doc); err != nil {
+			if err == io.EOF {
+				return nil, nil, err
+			}
+			return nil, nil, &storage.Error{Code: storage.InternalErr, Message: fmt.Sprintf("invalid document: %v", err)}
+		}
+		if doc.Path == nil {
+			return nil, nil, &storage.Error{Code: storage.InternalErr, Message: "invalid document: missing path"}
+		}
+		path, ok := storage.ParsePathEscaped(*doc.Path)
+		if !ok {
+			return nil, nil, &storage.Error{Code: storage.InternalErr, Message: fmt.Sprintf("invalid document: invalid path %q", *doc.Path)}
+		}
+		return path, doc.Value, nil
+	}
+}
+
+// BulkLoadOptions contains parameters that configure BulkLoad.
+type BulkLoadOptions struct {
+	// Progress, if set, is invoked periodically while documents are loaded
+	// and once loading finishes.
+	Progress func(BulkLoadStats)
+
+	// ProgressInterval is the minimum delay between calls to Progress.
+	// Defaults to one second.
+	ProgressInterval time.Duration
+}
+
+// BulkLoadStats contains counters for a bulk load.
+type BulkLoadStats struct {
+	Documents uint64        // documents read from the iterator
+	Keys      uint64        // keys written
+	Bytes     uint64        // encoded bytes written
+	Elapsed   time.Duration // time since the load started
+}
+
+// Rate returns the number of keys written per second.
+func (st BulkLoadStats) Rate() float64 {
+	if st.Elapsed <= 0 {
+		return 0
+	}
+	return float64(st.Keys) / st.Elapsed.Seconds()
+}
+
+// BulkLoad writes the documents returned by it to the store. Documents are
+// split across partitions the same way as Write but they are written with a
+// badger WriteBatch instead of a transaction, so the load is not atomic and
+// is not limited in size. Documents replace the keys they are stored in;
+// other keys are left intact, so documents can be loaded in any order. A
+// document cannot be loaded at a path inside a document stored in a single
+// key. Triggers are not invoked.
+//
+// BulkLoad does not use badger's StreamWriter because it requires sorted
+// input and replaces the entire contents of the database.
+func (s *Store) BulkLoad(ctx context.Context, it DocumentIterator, opts BulkLoadOptions) (BulkLoadStats, error) {
+
+	if _, err := s.acquire(); err != nil {
+		return BulkLoadStats{}, err
+	}
+
+	defer s.active.Done()
+
+	interval := opts.ProgressInterval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+
+	var stats BulkLoadStats
+	start := time.Now()
+	last := start
+
+	// Cached values do not need to be invalidated because cache entries are
+	// tagged with the version of the key that they were decoded from.
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	set := func(path storage.Path, val interface{}) error {
+		bs, err := s.codec.Marshal(val)
+		if err != nil {
+			return err
+		}
+		if err := wb.Set(keyFor(path), bs); err != nil {
+			return err
+		}
+		stats.Keys++
+		stats.Bytes += uint64(len(bs))
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, wrapError(err)
+		}
+
+		path, val, err := it()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return stats, wrapError(err)
+		}
+
+		stats.Documents++
+
+		if err := s.bulkWrite(path, val, set); err != nil {
+			return stats, wrapError(err)
+		}
+
+		if opts.Progress != nil {
+			if now := time.Now(); now.Sub(last) >= interval {
+				last = now
+				stats.Elapsed = now.Sub(start)
+				opts.Progress(stats)
+			}
+		}
+	}
+
+	if err := wb.Flush(); err != nil {
+		return stats, wrapError(err)
+	}
+
+	stats.Elapsed = time.Since(start)
+
+	if opts.Progress != nil {
+		opts.Progress(stats)
+	}
+
+	return stats, nil
+}
+
+// bulkWrite invokes set for each key that stores part of the document val at
+// path.
+func (s *Store) bulkWrite(path storage.Path, val interface{}, set func(storage.Path, interface{}) error) error {
+
+	index, ok := s.keyIndex(path)
+	if ok {
+		if index != len(path) {
+			return &storage.Error{Code: storage.InvalidPatchErr, Message: fmt.Sprintf("%v: path is inside a stored document", path)}
+		}
+		return set(path, val)
+	}
+
+	var err error
+
+	splitErr := s.splitValue(path, val, func(key storage.Path, val interface{}) {
+		if err == nil {
+			err = set(key, val)
+		}
+	})
+
+	if splitErr != nil {
+		return splitErr
+	}
+
+	return err
+}
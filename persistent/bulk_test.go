@@ -0,0 +1,133 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestBulkLoad(t *testing.T) {
+	s := newInMemoryStore(t, []storage.Path{{"users"}, {"groups", "*"}})
+	defer s.Close()
+	ctx := context.Background()
+
+	err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/users"), map[string]interface{}{
+		"alice": "old",
+		"bob":   "old",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := `
+		{"path": "/users/alice", "value": {"roles": ["admin"]}}
+		{"path": "/", "value": {"groups": {"eng": {"a": 1, "b": 2}}, "other": "x"}}
+		{"path": "/groups/ops/c", "value": 3}
+	`
+
+	var progress []BulkLoadStats
+
+	stats, err := s.BulkLoad(ctx, NewNDJSONIterator(strings.NewReader(input)), BulkLoadOptions{
+		Progress: func(stats BulkLoadStats) {
+			progress = append(progress, stats)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Documents != 3 || stats.Keys != 5 || stats.Bytes == 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	if len(progress) != 1 || progress[0] != stats {
+		t.Fatalf("expected final progress report but got: %+v", progress)
+	}
+
+	result, err := storage.ReadOne(ctx, s, storage.MustParsePath("/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := util.MustUnmarshalJSON([]byte(`{
+		"users": {"alice": {"roles": ["admin"]}, "bob": "old"},
+		"groups": {"eng": {"a": 1, "b": 2}, "ops": {"c": 3}},
+		"other": "x"
+	}`))
+
+	if !reflect.DeepEqual(result, exp) {
+		t.Fatalf("expected %v but got %v", exp, result)
+	}
+}
+
+func TestBulkLoadErrors(t *testing.T) {
+
+	tests := []struct {
+		note  string
+		input string
+		code  string
+	}{
+		{
+			note:  "malformed",
+			input: `{"path": "/users/alice"`,
+			code:  storage.InternalErr,
+		},
+		{
+			note:  "missing path",
+			input: `{"value": 1}`,
+			code:  storage.InternalErr,
+		},
+		{
+			note:  "invalid path",
+			input: `{"path": "users", "value": 1}`,
+			code:  storage.InternalErr,
+		},
+		{
+			note:  "inside document",
+			input: `{"path": "/users/alice/roles", "value": 1}`,
+			code:  storage.InvalidPatchErr,
+		},
+		{
+			note:  "unpartitionable",
+			input: `{"path": "/users", "value": 1}`,
+			code:  storage.InternalErr,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			s := newInMemoryStore(t, []storage.Path{{"users"}})
+			defer s.Close()
+			_, err := s.BulkLoad(context.Background(), NewNDJSONIterator(strings.NewReader(tc.input)), BulkLoadOptions{})
+			if serr, ok := err.(*storage.Error); !ok || serr.Code != tc.code {
+				t.Fatalf("expected %v error but got: %v", tc.code, err)
+			}
+		})
+	}
+
+	s := newInMemoryStore(t, nil)
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	it := func() (storage.Path, interface{}, error) {
+		return nil, nil, io.EOF
+	}
+	_, err := s.BulkLoad(ctx, it, BulkLoadOptions{})
+	if serr, ok := err.(*storage.Error); !ok || serr.Code != storage.InternalErr || serr.Message != context.Canceled.Error() {
+		t.Fatalf("expected cancellation error but got: %v", err)
+	}
+
+	it = func() (storage.Path, interface{}, error) {
+		return nil, nil, errors.New("iterator failed")
+	}
+	_, err = s.BulkLoad(context.Background(), it, BulkLoadOptions{})
+	if serr, ok := err.(*storage.Error); !ok || serr.Code != storage.InternalErr {
+		t.Fatalf("expected internal error but got: %v", err)
+	}
+}
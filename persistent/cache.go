@@ -0,0 +1,135 @@
+package persistent
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// CacheStats contains counters for the decoded value cache.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// CacheStats returns the decoded value cache counters. The counters are zero
+// if the cache is disabled.
+func (s *Store) CacheStats() CacheStats {
+	if s.cache == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&s.cache.hits),
+		Misses: atomic.LoadUint64(&s.cache.misses),
+	}
+}
+
+// decodeCached returns the value stored in item, decoding it only if the cache
+// does not contain the value for the item's version. The returned value is
+// shared and must not be modified.
+func (s *Store) decodeCached(item *badger.Item) (interface{}, error) {
+
+	key, version := item.Key(), item.Version()
+
+	if x, ok := s.cache.get(key, version); ok {
+		return x, nil
+	}
+
+	x, err := s.decode(item)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.put(key, version, x)
+	return x, nil
+}
+
+// valueCache is a bounded LRU cache of decoded values. Entries are keyed by
+// badger key and tagged with the version of the item they were decoded from so
+// that readers never observe values from other versions.
+type valueCache struct {
+	hits    uint64 // accessed atomically
+	misses  uint64 // accessed atomically
+	mu      sync.Mutex
+	size    int
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	version uint64
+	value   interface{}
+}
+
+func newValueCache(size int) *valueCache {
+	return &valueCache{
+		size:    size,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (c *valueCache) get(key []byte, version uint64) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[string(key)]; ok {
+		if entry := elem.Value.(*cacheEntry); entry.version == version {
+			c.lru.MoveToFront(elem)
+			atomic.AddUint64(&c.hits, 1)
+			return entry.value, true
+		}
+	}
+	atomic.AddUint64(&c.misses, 1)
+	return nil, false
+}
+
+func (c *valueCache) put(key []byte, version uint64, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[string(key)]; ok {
+		entry := elem.Value.(*cacheEntry)
+		// readers with older snapshots must not replace newer values.
+		if entry.version < version {
+			entry.version = version
+			entry.value = value
+		}
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	entry := &cacheEntry{key: string(key), version: version, value: value}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate removes the entries for keys from the cache.
+func (c *valueCache) invalidate(keys [][]byte) {
+	if len(keys) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if elem, ok := c.entries[string(key)]; ok {
+			c.lru.Remove(elem)
+			delete(c.entries, string(key))
+		}
+	}
+}
+
+// reset removes all entries from the cache.
+func (c *valueCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+}
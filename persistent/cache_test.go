@@ -0,0 +1,96 @@
+package persistent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/open-policy-agent/opa/storage"
+)
+
+func TestValueCache(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(Options{InMemory: true, Partitions: []storage.Path{{"users"}}, CacheSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/users/alice"), "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(exp interface{}) {
+		t.Helper()
+		val, err := storage.ReadOne(ctx, s, storage.MustParsePath("/users/alice"))
+		if err != nil {
+			t.Fatal(err)
+		} else if val != exp {
+			t.Fatalf("expected %v but got %v", exp, val)
+		}
+	}
+
+	read("admin")
+	read("admin")
+
+	if exp, stats := (CacheStats{Hits: 1, Misses: 1}), s.CacheStats(); exp != stats {
+		t.Fatalf("expected %+v but got %+v", exp, stats)
+	}
+
+	err = storage.Txn(ctx, s, storage.WriteParams, func(txn storage.Transaction) error {
+		if err := s.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/users/alice"), "guest"); err != nil {
+			return err
+		}
+		val, err := s.Read(ctx, txn, storage.MustParsePath("/users/alice"))
+		if err != nil {
+			return err
+		} else if val != "guest" {
+			t.Fatalf("expected uncommitted value but got %v", val)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read("guest")
+	read("guest")
+
+	if exp, stats := (CacheStats{Hits: 2, Misses: 2}), s.CacheStats(); exp != stats {
+		t.Fatalf("expected %+v but got %+v", exp, stats)
+	}
+}
+
+func TestValueCacheEviction(t *testing.T) {
+
+	c := newValueCache(2)
+
+	c.put([]byte("a"), 1, "a1")
+	c.put([]byte("b"), 1, "b1")
+
+	if _, ok := c.get([]byte("a"), 1); !ok {
+		t.Fatal("expected hit for a")
+	}
+
+	c.put([]byte("c"), 1, "c1")
+
+	if _, ok := c.get([]byte("b"), 1); ok {
+		t.Fatal("expected least recently used entry to be evicted")
+	}
+
+	c.put([]byte("a"), 2, "a2")
+	c.put([]byte("a"), 1, "a1")
+
+	if x, ok := c.get([]byte("a"), 2); !ok || x != "a2" {
+		t.Fatalf("expected newer version to be retained but got %v", x)
+	}
+
+	if _, ok := c.get([]byte("a"), 1); ok {
+		t.Fatal("expected miss for older version")
+	}
+
+	c.invalidate([][]byte{[]byte("a")})
+
+	if _, ok := c.get([]byte("a"), 2); ok {
+		t.Fatal("expected miss after invalidation")
+	}
+}
@@ -0,0 +1,186 @@
+package persistent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// Codec serializes the values stored in badger. The name of the codec used to
+// write a store is recorded in the store metadata so that the store can be
+// reopened without specifying the codec again.
+type Codec interface {
+	// Name identifies the codec in the store metadata.
+	Name() string
+
+	// Marshal serializes v.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal deserializes bs. Objects must be returned as
+	// map[string]interface{}, arrays as []interface{}, and numbers as
+	// json.Number. Implementations must not retain bs.
+	Unmarshal(bs []byte) (interface{}, error)
+}
+
+var (
+	// JSON stores values as JSON text. JSON is the default codec.
+	JSON Codec = jsonCodec{}
+
+	// CBOR stores values in the Concise Binary Object Representation (RFC
+	// 8949), which is more compact and faster to decode than JSON. Numbers
+	// are stored without loss of precision.
+	CBOR Codec = newCBORCodec()
+)
+
+var codecs = map[string]Codec{
+	JSON.Name(): JSON,
+	CBOR.Name(): CBOR,
+}
+
+func errUnknownCodec(name string) *storage.Error {
+	return &storage.Error{Code: storage.InternalErr, Message: fmt.Sprintf("unknown codec %q", name)}
+}
+
+func errCodecMismatch(name, recorded string) *storage.Error {
+	return &storage.Error{Code: storage.InternalErr, Message: fmt.Sprintf("codec %q does not match codec %q recorded in store", name, recorded)}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(bs []byte) (interface{}, error) {
+	var x interface{}
+	err := util.NewJSONDecoder(bytes.NewReader(bs)).Decode(&x)
+	return x, err
+}
+
+// cborNumberTag identifies numbers that cannot be represented exactly by CBOR
+// integers or floats. The tag content is the number's JSON text. The tag is in
+// the range that is unassigned by IANA.
+const cborNumberTag = 0x4f5041
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBORCodec() cborCodec {
+
+	enc, err := cbor.EncOptions{}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+
+	dec, err := cbor.DecOptions{
+		MaxNestedLevels:  1024,
+		MaxArrayElements: math.MaxInt32,
+		MaxMapPairs:      math.MaxInt32,
+		DefaultMapType:   reflect.TypeOf(map[string]interface{}(nil)),
+		UTF8:             cbor.UTF8DecodeInvalid,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+
+	return cborCodec{enc: enc, dec: dec}
+}
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+func (c cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return c.enc.Marshal(cborEncodeNumbers(v))
+}
+
+func (c cborCodec) Unmarshal(bs []byte) (interface{}, error) {
+	var x interface{}
+	if err := c.dec.Unmarshal(bs, &x); err != nil {
+		return nil, err
+	}
+	return cborDecodeNumbers(x)
+}
+
+// cborEncodeNumbers returns a copy of x where json.Number values are replaced
+// with CBOR integers or floats when they can be represented exactly and with
+// tagged strings otherwise.
+func cborEncodeNumbers(x interface{}) interface{} {
+	switch x := x.(type) {
+	case map[string]interface{}:
+		cpy := make(map[string]interface{}, len(x))
+		for k, v := range x {
+			cpy[k] = cborEncodeNumbers(v)
+		}
+		return cpy
+	case []interface{}:
+		cpy := make([]interface{}, len(x))
+		for i := range x {
+			cpy[i] = cborEncodeNumbers(x[i])
+		}
+		return cpy
+	case json.Number:
+		s := string(x)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(i, 10) == s {
+			return i
+		}
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil && strconv.FormatUint(u, 10) == s {
+			return u
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil && strconv.FormatFloat(f, 'g', -1, 64) == s {
+			return f
+		}
+		return cbor.Tag{Number: cborNumberTag, Content: s}
+	}
+	return x
+}
+
+// cborDecodeNumbers replaces CBOR numbers in x with json.Number values. The
+// value is modified in-place.
+func cborDecodeNumbers(x interface{}) (interface{}, error) {
+	switch x := x.(type) {
+	case map[string]interface{}:
+		for k, v := range x {
+			v, err := cborDecodeNumbers(v)
+			if err != nil {
+				return nil, err
+			}
+			x[k] = v
+		}
+		return x, nil
+	case []interface{}:
+		for i := range x {
+			v, err := cborDecodeNumbers(x[i])
+			if err != nil {
+				return nil, err
+			}
+			x[i] = v
+		}
+		return x, nil
+	case uint64:
+		return json.Number(strconv.FormatUint(x, 10)), nil
+	case int64:
+		return json.Number(strconv.FormatInt(x, 10)), nil
+	case float64:
+		return json.Number(strconv.FormatFloat(x, 'g', -1, 64)), nil
+	case cbor.Tag:
+		if s, ok := x.Content.(string); ok && x.Number == cborNumberTag {
+			return json.Number(s), nil
+		}
+		return nil, fmt.Errorf("cbor: unexpected tag %d", x.Number)
+	}
+	return x, nil
+}
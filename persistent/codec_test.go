@@ -0,0 +1,145 @@
+package persistent
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util"
+	"github.com/open-policy-agent/opa/util/test"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+
+	value := util.MustUnmarshalJSON([]byte(`{
+		"str": "a/b",
+		"bool": true,
+		"null": null,
+		"arr": [1, -5, 1.5, 0.1, 1e3, 1.50],
+		"ints": [9007199254740993, 18446744073709551615, 123456789012345678901234567890],
+		"obj": {"x": {"y": []}}
+	}`))
+
+	for _, codec := range []Codec{JSON, CBOR} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			bs, err := codec.Marshal(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := codec.Unmarshal(bs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(value, result) {
+				t.Fatalf("expected %v but got %v", value, result)
+			}
+		})
+	}
+}
+
+func TestCodecMetadata(t *testing.T) {
+	test.WithTempFS(map[string]string{}, func(dir string) {
+		ctx := context.Background()
+		partitions := []storage.Path{{"test"}}
+
+		s, err := New(Options{Dir: dir, Partitions: partitions, Codec: CBOR})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/test/a"), map[string]interface{}{"b": "c"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := New(Options{Dir: dir, Partitions: partitions, Codec: JSON}); err == nil {
+			t.Fatal("expected error for codec mismatch")
+		}
+
+		s = newTestStore(t, dir, partitions)
+		defer s.Close()
+
+		if s.codec != CBOR {
+			t.Fatalf("expected recorded codec to be used but got %v", s.codec.Name())
+		}
+
+		val, err := storage.ReadOne(ctx, s, storage.MustParsePath("/test/a/b"))
+		if err != nil {
+			t.Fatal(err)
+		} else if val != "c" {
+			t.Fatalf("expected c but got %v", val)
+		}
+	})
+}
+
+func TestReadScanEquivalence(t *testing.T) {
+
+	value := util.MustUnmarshalJSON([]byte(`{
+		"alice": {"id": 9007199254740993, "roles": ["admin"], "score": 1.5},
+		"bob": {"id": 123456789012345678901234567890, "roles": [], "score": 2}
+	}`)).(map[string]interface{})
+
+	for _, codec := range []Codec{JSON, CBOR} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			test.WithTempFS(map[string]string{}, func(dir string) {
+				ctx := context.Background()
+				s, err := New(Options{Dir: dir, Partitions: []storage.Path{{"users"}}, Codec: codec})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.Close()
+
+				if err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/users"), value); err != nil {
+					t.Fatal(err)
+				}
+
+				scan, err := storage.ReadOne(ctx, s, storage.MustParsePath("/users"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				root, err := storage.ReadOne(ctx, s, storage.Path{})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !reflect.DeepEqual(value, scan) {
+					t.Fatalf("expected scan to return %v but got %v", value, scan)
+				}
+
+				if exp := map[string]interface{}{"users": value}; !reflect.DeepEqual(exp, root) {
+					t.Fatalf("expected root scan to return %v but got %v", exp, root)
+				}
+
+				for k, exp := range value {
+					val, err := storage.ReadOne(ctx, s, storage.Path{"users", k})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(exp, val) {
+						t.Fatalf("expected point read to return %v but got %v", exp, val)
+					}
+					if !reflect.DeepEqual(scan.(map[string]interface{})[k], val) {
+						t.Fatalf("expected point read and scan to match for %v", k)
+					}
+				}
+
+				// read-modify-write must not alter numbers that are not modified
+				if err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/users/alice/roles/-"), "dev"); err != nil {
+					t.Fatal(err)
+				}
+
+				val, err := storage.ReadOne(ctx, s, storage.MustParsePath("/users/alice/id"))
+				if err != nil {
+					t.Fatal(err)
+				} else if exp := value["alice"].(map[string]interface{})["id"]; exp != val {
+					t.Fatalf("expected %v (%T) but got %v (%T)", exp, exp, val, val)
+				}
+			})
+		})
+	}
+}
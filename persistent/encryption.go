@@ -0,0 +1,92 @@
+package persistent
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+var errInvalidEncryptionKey = &storage.Error{Code: storage.InternalErr, Message: "encryption key must be 16, 24 or 32 bytes"}
+var errEncryptionKeyMismatch = &storage.Error{Code: storage.InternalErr, Message: "encryption key does not match the key that the store was written with"}
+
+// EncryptionKeyFromFile returns the encryption key stored in the file name.
+// The file contains the raw key bytes.
+func EncryptionKeyFromFile(name string) ([]byte, error) {
+	key, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return key, checkEncryptionKey(key)
+}
+
+// EncryptionKeyFromEnv returns the encryption key stored in the environment
+// variable name. The variable contains the hex-encoded key (e.g., the output
+// of "openssl rand -hex 32") because environment variables cannot contain
+// arbitrary bytes.
+func EncryptionKeyFromEnv(name string) ([]byte, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, &storage.Error{Code: storage.InternalErr, Message: fmt.Sprintf("environment variable %v is not set", name)}
+	}
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, &storage.Error{Code: storage.InternalErr, Message: fmt.Sprintf("environment variable %v does not contain a hex-encoded key: %v", name, err)}
+	}
+	return key, checkEncryptionKey(key)
+}
+
+// RotateEncryptionKey changes the encryption key of the store in dir from
+// oldKey to newKey. Only the data keys that badger encrypts stored values
+// with are re-encrypted so rotation does not depend on the size of the store.
+// If oldKey is empty, encryption is enabled for data written from then on.
+// The store must not be open.
+func RotateEncryptionKey(dir string, oldKey, newKey []byte) error {
+
+	if len(oldKey) > 0 {
+		if err := checkEncryptionKey(oldKey); err != nil {
+			return err
+		}
+	}
+
+	if err := checkEncryptionKey(newKey); err != nil {
+		return err
+	}
+
+	opts := badger.KeyRegistryOptions{
+		Dir:           dir,
+		EncryptionKey: oldKey,
+	}
+
+	reg, err := badger.OpenKeyRegistry(opts)
+	if err != nil {
+		return wrapEncryptionError(err)
+	}
+
+	defer reg.Close()
+
+	opts.EncryptionKey = newKey
+
+	return wrapError(badger.WriteKeyRegistry(reg, opts))
+}
+
+func checkEncryptionKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return errInvalidEncryptionKey
+}
+
+// wrapEncryptionError is like wrapError except that key mismatches are
+// reported clearly.
+func wrapEncryptionError(err error) error {
+	if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		return errEncryptionKeyMismatch
+	}
+	return wrapError(err)
+}
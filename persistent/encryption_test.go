@@ -0,0 +1,167 @@
+package persistent
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util/test"
+)
+
+func TestEncryption(t *testing.T) {
+
+	key1 := []byte("0123456789abcdef")
+	key2 := []byte("fedcba9876543210fedcba9876543210")
+	secret := "correct horse battery staple"
+
+	files := map[string]string{
+		"key1": string(key1),
+	}
+
+	test.WithTempFS(files, func(root string) {
+		ctx := context.Background()
+		dir := filepath.Join(root, "store")
+
+		open := func(key []byte) (*Store, error) {
+			return New(Options{Dir: dir, Partitions: []storage.Path{{"users"}}, EncryptionKey: key})
+		}
+
+		key, err := EncryptionKeyFromFile(filepath.Join(root, "key1"))
+		if err != nil || !bytes.Equal(key, key1) {
+			t.Fatalf("unexpected key %q: %v", key, err)
+		}
+
+		s, err := open(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/users/alice"), secret); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		err = filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			bs, err := ioutil.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			if bytes.Contains(bs, []byte(secret)) {
+				t.Fatalf("%v contains plaintext", name)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, key := range [][]byte{nil, key2} {
+			if _, err := open(key); err != errEncryptionKeyMismatch {
+				t.Fatalf("expected key mismatch error but got: %v", err)
+			}
+		}
+
+		if err := RotateEncryptionKey(dir, key2, key1); err != errEncryptionKeyMismatch {
+			t.Fatalf("expected key mismatch error but got: %v", err)
+		}
+
+		if err := RotateEncryptionKey(dir, key1, key2); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := open(key1); err != errEncryptionKeyMismatch {
+			t.Fatalf("expected key mismatch error but got: %v", err)
+		}
+
+		os.Setenv("TEST_ENCRYPTION_KEY", hex.EncodeToString(key2))
+		defer os.Unsetenv("TEST_ENCRYPTION_KEY")
+
+		key, err = EncryptionKeyFromEnv("TEST_ENCRYPTION_KEY")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err = open(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		result, err := storage.ReadOne(ctx, s, storage.MustParsePath("/users/alice"))
+		if err != nil || result != secret {
+			t.Fatalf("unexpected result %v: %v", result, err)
+		}
+	})
+}
+
+func TestEncryptionKeyErrors(t *testing.T) {
+	test.WithTempFS(map[string]string{"bad": "short"}, func(root string) {
+		if _, err := EncryptionKeyFromFile(filepath.Join(root, "bad")); err != errInvalidEncryptionKey {
+			t.Fatalf("expected invalid key error but got: %v", err)
+		}
+		if _, err := EncryptionKeyFromFile(filepath.Join(root, "missing")); err == nil {
+			t.Fatal("expected error")
+		}
+		if _, err := EncryptionKeyFromEnv("TEST_ENCRYPTION_KEY_MISSING"); err == nil {
+			t.Fatal("expected error")
+		}
+		defer os.Unsetenv("TEST_ENCRYPTION_KEY_BAD")
+		os.Setenv("TEST_ENCRYPTION_KEY_BAD", "0123456789abcdef")
+		if _, err := EncryptionKeyFromEnv("TEST_ENCRYPTION_KEY_BAD"); err != errInvalidEncryptionKey {
+			t.Fatalf("expected invalid key error but got: %v", err)
+		}
+		os.Setenv("TEST_ENCRYPTION_KEY_BAD", "not a hex-encoded key!!!!!!!!!!!")
+		if _, err := EncryptionKeyFromEnv("TEST_ENCRYPTION_KEY_BAD"); err == nil || !strings.Contains(err.Error(), "hex-encoded") {
+			t.Fatalf("expected hex error but got: %v", err)
+		}
+		if _, err := New(Options{Dir: root, EncryptionKey: []byte("short")}); err != errInvalidEncryptionKey {
+			t.Fatalf("expected invalid key error but got: %v", err)
+		}
+	})
+}
+
+func TestEnableEncryption(t *testing.T) {
+	test.WithTempFS(map[string]string{}, func(dir string) {
+		ctx := context.Background()
+		key := []byte("0123456789abcdef")
+
+		s := newTestStore(t, dir, nil)
+		if err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/x"), "before"); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		if err := RotateEncryptionKey(dir, nil, key); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := New(Options{Dir: dir, EncryptionKey: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/y"), "after"); err != nil {
+			t.Fatal(err)
+		}
+
+		for path, exp := range map[string]string{"/x": "before", "/y": "after"} {
+			result, err := storage.ReadOne(ctx, s, storage.MustParsePath(path))
+			if err != nil || result != exp {
+				t.Fatalf("%v: unexpected result %v: %v", path, result, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package persistent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/open-policy-agent/opa/storage"
+)
+
+// ExportJSON writes the document at path to w as a single JSON value. The
+// document is written incrementally while iterating over the keys that store
+// it so that memory use does not depend on the size of the document.
+func (s *Store) ExportJSON(ctx context.Context, w io.Writer, path storage.Path) error {
+
+	bw := bufio.NewWriter(w)
+
+	err := storage.Txn(ctx, s, storage.TransactionParams{}, func(txn storage.Transaction) error {
+
+		if _, _, scan := s.partitionRead(path); !scan {
+			return s.Iterate(ctx, txn, path, func(_ storage.Path, val interface{}) error {
+				return writeJSON(bw, val)
+			})
+		}
+
+		ow := &objectWriter{w: bw}
+		ow.begin()
+
+		err := s.Iterate(ctx, txn, path, func(p storage.Path, val interface{}) error {
+			return ow.member(p[len(path):], val)
+		})
+
+		if err != nil {
+			return err
+		}
+
+		ow.end()
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return wrapError(bw.Flush())
+}
+
+// ExportNDJSON writes the document at path to w as newline-delimited records
+// with the same format that is read by NewNDJSONIterator. Each record
+// contains the path and value of a document stored in a single key. If path
+// refers to a document inside a key, the record of that key is written.
+func (s *Store) ExportNDJSON(ctx context.Context, w io.Writer, path storage.Path) error {
+
+	// records inside keys cannot be loaded so export the containing key.
+	if index, ok := s.keyIndex(path); ok {
+		path = path[:index]
+	}
+
+	bw := bufio.NewWriter(w)
+
+	err := storage.Txn(ctx, s, storage.TransactionParams{}, func(txn storage.Transaction) error {
+		return s.Iterate(ctx, txn, path, func(p storage.Path, val interface{}) error {
+			err := writeJSON(bw, struct {
+				Path  string      `json:"path"`
+				Value interface{} `json:"value"`
+			}{p.String(), val})
+			if err != nil {
+				return err
+			}
+			return wrapError(bw.WriteByte('\n'))
+		})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return wrapError(bw.Flush())
+}
+
+func writeJSON(w *bufio.Writer, x interface{}) error {
+	bs, err := json.Marshal(x)
+	if err != nil {
+		return wrapError(err)
+	}
+	_, err = w.Write(bs)
+	return wrapError(err)
+}
+
+// objectWriter writes a JSON object from its members in path order. Members
+// that share a path prefix must be written consecutively, which holds for
+// keys returned by badger iterators.
+type objectWriter struct {
+	w     *bufio.Writer
+	open  storage.Path // path of the innermost open object
+	empty bool         // true if no members have been written to the innermost object
+}
+
+func (ow *objectWriter) begin() {
+	ow.w.WriteByte('{')
+	ow.empty = true
+}
+
+func (ow *objectWriter) end() {
+	ow.close(0)
+	ow.w.WriteByte('}')
+}
+
+// member writes val at path relative to the root object.
+func (ow *objectWriter) member(path storage.Path, val interface{}) error {
+
+	parent := path[:len(path)-1]
+
+	common := 0
+	for common < len(ow.open) && common < len(parent) && ow.open[common] == parent[common] {
+		common++
+	}
+
+	ow.close(common)
+
+	for _, k := range parent[common:] {
+		if err := ow.key(k); err != nil {
+			return err
+		}
+		ow.w.WriteByte('{')
+		ow.open = append(ow.open, k)
+		ow.empty = true
+	}
+
+	if err := ow.key(path[len(path)-1]); err != nil {
+		return err
+	}
+
+	ow.empty = false
+	return writeJSON(ow.w, val)
+}
+
+// close closes open objects until n remain.
+func (ow *objectWriter) close(n int) {
+	for len(ow.open) > n {
+		ow.w.WriteByte('}')
+		ow.open = ow.open[:len(ow.open)-1]
+		ow.empty = false
+	}
+}
+
+func (ow *objectWriter) key(k string) error {
+	if !ow.empty {
+		ow.w.WriteByte(',')
+	}
+	if err := writeJSON(ow.w, k); err != nil {
+		return err
+	}
+	return ow.w.WriteByte(':')
+}
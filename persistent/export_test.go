@@ -0,0 +1,109 @@
+package persistent
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestExport(t *testing.T) {
+	partitions := []storage.Path{{"users"}, {"groups", "*"}}
+	s := newInMemoryStore(t, partitions)
+	defer s.Close()
+	ctx := context.Background()
+
+	data := util.MustUnmarshalJSON([]byte(`{
+		"users": {"alice": {"roles": ["admin"]}, "bob/carol": {"roles": []}},
+		"groups": {"eng": {"a": 1, "b": {"c": 2}}, "ops": {}, "sre": {"d": "<e>"}},
+		"other": {"x": "y"}
+	}`))
+
+	if err := storage.WriteOne(ctx, s, storage.AddOp, storage.Path{}, data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/", "/users", "/groups", "/groups/eng", "/groups/ops", "/groups/none", "/users/alice", "/users/alice/roles", "/other"} {
+		t.Run(path, func(t *testing.T) {
+			exp, err := storage.ReadOne(ctx, s, storage.MustParsePath(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := s.ExportJSON(ctx, &buf, storage.MustParsePath(path)); err != nil {
+				t.Fatal(err)
+			}
+			var result interface{}
+			if err := util.UnmarshalJSON(buf.Bytes(), &result); err != nil {
+				t.Fatalf("invalid output %q: %v", buf.String(), err)
+			}
+			if !reflect.DeepEqual(exp, result) {
+				t.Fatalf("expected %v but got %v", exp, result)
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := s.ExportJSON(ctx, &buf, storage.MustParsePath("/users/dave")); !storage.IsNotFound(err) {
+		t.Fatalf("expected not found error but got: %v", err)
+	}
+
+	if err := s.ExportNDJSON(ctx, &buf, storage.Path{}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newInMemoryStore(t, partitions)
+	defer dst.Close()
+
+	if _, err := dst.BulkLoad(ctx, NewNDJSONIterator(&buf), BulkLoadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	exp, err := storage.ReadOne(ctx, s, storage.Path{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := storage.ReadOne(ctx, dst, storage.Path{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(exp, result) {
+		t.Fatalf("expected %v but got %v", exp, result)
+	}
+
+	// Exporting a path inside a key exports the key.
+	buf.Reset()
+
+	if err := s.ExportNDJSON(ctx, &buf, storage.MustParsePath("/users/alice/roles")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst = newInMemoryStore(t, partitions)
+	defer dst.Close()
+
+	stats, err := dst.BulkLoad(ctx, NewNDJSONIterator(&buf), BulkLoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	} else if stats.Documents != 1 {
+		t.Fatalf("expected one document but got %d", stats.Documents)
+	}
+
+	exp, err = storage.ReadOne(ctx, s, storage.MustParsePath("/users/alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = storage.ReadOne(ctx, dst, storage.MustParsePath("/users/alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(exp, result) {
+		t.Fatalf("expected %v but got %v", exp, result)
+	}
+}
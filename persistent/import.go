@@ -0,0 +1,220 @@
+package persistent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// ImportOptions contains parameters that configure Import.
+type ImportOptions struct {
+	// Progress, if set, is invoked periodically while files are imported and
+	// once importing finishes.
+	Progress func(ImportStats)
+
+	// ProgressInterval is the minimum delay between calls to Progress.
+	// Defaults to one second.
+	ProgressInterval time.Duration
+}
+
+// ImportStats contains counters for an import.
+type ImportStats struct {
+	Files   uint64        // files imported
+	Bytes   uint64        // bytes read from files
+	Elapsed time.Duration // time since the import started
+}
+
+// Import reads JSON and YAML data files from root and writes them to the
+// store. If root is a file, its contents are written at the root of the
+// document regardless of its extension. If root is a directory, files are
+// loaded the same way as "opa run" loads data: the contents of each .json,
+// .yaml and .yml file are written at the path formed by the names of the
+// directories that contain it, relative to root. Other files are ignored.
+//
+// Files are merged into the existing data: objects are merged recursively and
+// other values replace existing values. Files are written with a load
+// transaction (see NewLoadTransaction) so imports are not limited in size but
+// they are not atomic either.
+func (s *Store) Import(ctx context.Context, root string, opts ImportOptions) (ImportStats, error) {
+
+	interval := opts.ProgressInterval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+
+	var stats ImportStats
+	start := time.Now()
+	last := start
+
+	txn, err := s.NewLoadTransaction(ctx)
+	if err != nil {
+		return stats, err
+	}
+
+	err = filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || (name != root && !isDataFile(name)) {
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		path, err := importPath(root, name)
+		if err != nil {
+			return err
+		}
+
+		bs, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		var value interface{}
+
+		if filepath.Ext(name) == ".json" {
+			err = util.UnmarshalJSON(bs, &value)
+		} else {
+			err = util.Unmarshal(bs, &value)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+
+		if err := s.merge(ctx, txn, path, value); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+
+		stats.Files++
+		stats.Bytes += uint64(len(bs))
+
+		if opts.Progress != nil {
+			if now := time.Now(); now.Sub(last) >= interval {
+				last = now
+				stats.Elapsed = now.Sub(start)
+				opts.Progress(stats)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		s.Abort(ctx, txn)
+		return stats, wrapError(err)
+	}
+
+	if err := s.Commit(ctx, txn); err != nil {
+		return stats, err
+	}
+
+	stats.Elapsed = time.Since(start)
+
+	if opts.Progress != nil {
+		opts.Progress(stats)
+	}
+
+	return stats, nil
+}
+
+func isDataFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// importPath returns the path that the contents of the file name are written
+// at.
+func importPath(root, name string) (storage.Path, error) {
+
+	if name == root {
+		return storage.Path{}, nil
+	}
+
+	rel, err := filepath.Rel(root, filepath.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if rel == "." {
+		return storage.Path{}, nil
+	}
+
+	return storage.Path(strings.Split(filepath.ToSlash(rel), "/")), nil
+}
+
+// merge merges value into the document at path. Objects are merged
+// recursively and other values replace the existing value. Missing parent
+// documents are created.
+func (s *Store) merge(ctx context.Context, txn storage.Transaction, path storage.Path, value interface{}) error {
+
+	index, ok := s.keyIndex(path)
+
+	// The document at path is split across keys so merge each child into the
+	// existing data without reading the entire document.
+	if !ok {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return errValueUnpartionable(path)
+		}
+		for k, v := range obj {
+			if err := s.merge(ctx, txn, appendPath(path, k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	existing, err := s.Read(ctx, txn, path)
+	if err != nil {
+		if !storage.IsNotFound(err) {
+			return err
+		}
+
+		// Keys can be created without a parent. Inside of keys, the parent
+		// must exist so merge an object containing value into the parent.
+		if index == len(path) {
+			return s.Write(ctx, txn, storage.AddOp, path, value)
+		}
+
+		return s.merge(ctx, txn, path[:len(path)-1], map[string]interface{}{path[len(path)-1]: value})
+	}
+
+	return s.Write(ctx, txn, storage.AddOp, path, mergeValues(existing, value))
+}
+
+// mergeValues returns the result of merging b into a. The result may share
+// structure with a and b.
+func mergeValues(a, b interface{}) interface{} {
+
+	objA, okA := a.(map[string]interface{})
+	objB, okB := b.(map[string]interface{})
+
+	if !okA || !okB {
+		return b
+	}
+
+	for k, v := range objB {
+		if existing, ok := objA[k]; ok {
+			objA[k] = mergeValues(existing, v)
+		} else {
+			objA[k] = v
+		}
+	}
+
+	return objA
+}
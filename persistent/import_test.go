@@ -0,0 +1,82 @@
+package persistent
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util"
+	"github.com/open-policy-agent/opa/util/test"
+)
+
+func TestImport(t *testing.T) {
+
+	files := map[string]string{
+		"data/data.json":                `{"users": {"alice": {"roles": ["admin"]}}}`,
+		"data/groups/data.json":         `{"eng": {"b": 2}, "ops": {"c": 3}}`,
+		"data/groups/eng/data.yaml":     `a: 1`,
+		"data/other/x/data.json":        `"y"`,
+		"data/other/z.yml":              `w: true`,
+		"data/other/README.md":          `ignored`,
+		"single.txt":                    `{"other": {"v": 1}}`,
+		"invalid/data.json":             `{`,
+		"unpartitionable/groups/x.json": `1`,
+	}
+
+	test.WithTempFS(files, func(root string) {
+		s := newTestStore(t, filepath.Join(root, "store"), []storage.Path{{"users"}, {"groups", "*"}})
+		defer s.Close()
+		ctx := context.Background()
+
+		err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/users/bob"), "old")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var progress []ImportStats
+
+		stats, err := s.Import(ctx, filepath.Join(root, "data"), ImportOptions{
+			Progress: func(stats ImportStats) {
+				progress = append(progress, stats)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stats.Files != 5 || stats.Bytes == 0 {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
+
+		if len(progress) != 1 || progress[0] != stats {
+			t.Fatalf("expected final progress report but got: %+v", progress)
+		}
+
+		if _, err := s.Import(ctx, filepath.Join(root, "single.txt"), ImportOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := storage.ReadOne(ctx, s, storage.Path{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exp := util.MustUnmarshalJSON([]byte(`{
+			"users": {"alice": {"roles": ["admin"]}, "bob": "old"},
+			"groups": {"eng": {"a": 1, "b": 2}, "ops": {"c": 3}},
+			"other": {"x": "y", "w": true, "v": 1}
+		}`))
+
+		if !reflect.DeepEqual(exp, result) {
+			t.Fatalf("expected %v but got %v", exp, result)
+		}
+
+		for _, dir := range []string{"invalid", "unpartitionable", "missing"} {
+			if _, err := s.Import(ctx, filepath.Join(root, dir), ImportOptions{}); err == nil {
+				t.Fatalf("%v: expected error", dir)
+			}
+		}
+	})
+}
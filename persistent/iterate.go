@@ -0,0 +1,76 @@
+package persistent
+
+import (
+	"context"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+// Iterate invokes f for each document stored under path in key order. Unlike
+// Read, Iterate does not materialize the entire subtree: keys are pulled from
+// badger on demand and only one value is held in memory at a time. If path
+// refers to a document stored in a single key, f is invoked once with path.
+// If f returns an error, iteration stops and the error is returned.
+//
+// Iterate is only used by Go callers such as ExportJSON. Policy evaluation
+// does not use it: OPA's evaluator converts the result of Read into AST
+// values, so policies that iterate over a partition still load the entire
+// partition into memory.
+func (s *Store) Iterate(_ context.Context, txn storage.Transaction, path storage.Path, f func(storage.Path, interface{}) error) error {
+
+	t, err := s.underlying(txn)
+	if err != nil {
+		return err
+	}
+
+	if _, _, scan := s.partitionRead(path); !scan {
+		val, err := s.read(t, path)
+		if err != nil {
+			return wrapError(err)
+		}
+		return f(path, val)
+	}
+
+	var ferr error
+
+	err = s.scan(t.underlying, path, func(p storage.Path, val interface{}) error {
+		ferr = f(p, val)
+		return ferr
+	})
+
+	if ferr != nil {
+		return ferr
+	}
+
+	return wrapError(err)
+}
+
+// scan invokes f with the path and value of each key under path.
+func (s *Store) scan(txn *badger.Txn, path storage.Path, f func(storage.Path, interface{}) error) error {
+
+	it := txn.NewIterator(badger.IteratorOptions{
+		Prefix: scanPrefix(path),
+	})
+
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		p, err := keyPath(item.Key())
+		if err != nil {
+			return err
+		}
+
+		val, err := s.decode(item)
+		if err != nil {
+			return err
+		}
+
+		if err := f(p, val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
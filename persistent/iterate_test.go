@@ -0,0 +1,123 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/storage"
+)
+
+func TestIterate(t *testing.T) {
+	s := newInMemoryStore(t, []storage.Path{{"foo", "*"}})
+	defer s.Close()
+	ctx := context.Background()
+
+	err := storage.Txn(ctx, s, storage.WriteParams, func(txn storage.Transaction) error {
+		return s.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/"), map[string]interface{}{
+			"foo": map[string]interface{}{
+				"a": map[string]interface{}{"x": "1", "y": "2"},
+				"b": map[string]interface{}{"z": "3"},
+			},
+			"bar": "baz",
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		path string
+		val  interface{}
+	}
+
+	tests := []struct {
+		note  string
+		path  string
+		limit int
+		exp   []entry
+	}{
+		{
+			note: "root",
+			path: "/",
+			exp: []entry{
+				{"/bar", "baz"},
+				{"/foo/a/x", "1"},
+				{"/foo/a/y", "2"},
+				{"/foo/b/z", "3"},
+			},
+		},
+		{
+			note: "partition",
+			path: "/foo/a",
+			exp: []entry{
+				{"/foo/a/x", "1"},
+				{"/foo/a/y", "2"},
+			},
+		},
+		{
+			note: "single key",
+			path: "/foo/b/z",
+			exp: []entry{
+				{"/foo/b/z", "3"},
+			},
+		},
+		{
+			note: "inside key",
+			path: "/bar",
+			exp: []entry{
+				{"/bar", "baz"},
+			},
+		},
+		{
+			note:  "early stop",
+			path:  "/foo",
+			limit: 2,
+			exp: []entry{
+				{"/foo/a/x", "1"},
+				{"/foo/a/y", "2"},
+			},
+		},
+		{
+			note: "empty",
+			path: "/foo/c",
+		},
+	}
+
+	errStop := errors.New("stop")
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			var result []entry
+			err := storage.Txn(ctx, s, storage.TransactionParams{}, func(txn storage.Transaction) error {
+				return s.Iterate(ctx, txn, storage.MustParsePath(tc.path), func(path storage.Path, val interface{}) error {
+					result = append(result, entry{path.String(), val})
+					if len(result) == tc.limit {
+						return errStop
+					}
+					return nil
+				})
+			})
+			if tc.limit > 0 {
+				if err != errStop {
+					t.Fatalf("expected stop error but got: %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.exp, result) {
+				t.Fatalf("expected %v but got %v", tc.exp, result)
+			}
+		})
+	}
+
+	err = storage.Txn(ctx, s, storage.TransactionParams{}, func(txn storage.Transaction) error {
+		return s.Iterate(ctx, txn, storage.MustParsePath("/qux"), func(storage.Path, interface{}) error {
+			return nil
+		})
+	})
+	if !storage.IsNotFound(err) {
+		t.Fatalf("expected not found error but got: %v", err)
+	}
+}
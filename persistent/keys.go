@@ -0,0 +1,96 @@
+package persistent
+
+import (
+	"bytes"
+
+	"github.com/open-policy-agent/opa/storage"
+)
+
+// Data keys are encoded so that path segments may contain arbitrary bytes
+// (including "/" and "%") while preserving the order of paths and allowing
+// prefix scans. Each segment is followed by a terminator (0x00 0x01) and
+// 0x00 bytes inside of segments are escaped as 0x00 0xFF. Because the
+// terminator sorts before the escape sequence and every other byte, the
+// encoding preserves the byte-wise order of segments and the key of a path
+// is a prefix of the keys of its descendants (and only its descendants).
+
+// dataPrefix is the key prefix that documents are stored under.
+var dataPrefix = []byte("data/")
+
+const (
+	keyEscape     = 0x00
+	keyEscapeZero = 0xFF
+	keyTerminator = 0x01
+)
+
+func keyFor(path storage.Path) []byte {
+
+	n := len(dataPrefix)
+	for _, seg := range path {
+		n += len(seg) + 2
+	}
+
+	key := make([]byte, 0, n)
+	key = append(key, dataPrefix...)
+
+	for _, seg := range path {
+		for i := 0; i < len(seg); i++ {
+			if seg[i] == keyEscape {
+				key = append(key, keyEscape, keyEscapeZero)
+			} else {
+				key = append(key, seg[i])
+			}
+		}
+		key = append(key, keyEscape, keyTerminator)
+	}
+
+	return key
+}
+
+func keyPath(key []byte) (storage.Path, error) {
+
+	if !bytes.HasPrefix(key, dataPrefix) {
+		return nil, errInvalidKey
+	}
+
+	var path storage.Path
+	var seg []byte
+
+	for i := len(dataPrefix); i < len(key); i++ {
+		if key[i] != keyEscape {
+			seg = append(seg, key[i])
+			continue
+		}
+		i++
+		if i == len(key) {
+			return nil, errInvalidKey
+		}
+		switch key[i] {
+		case keyEscapeZero:
+			seg = append(seg, keyEscape)
+		case keyTerminator:
+			path = append(path, string(seg))
+			seg = seg[:0]
+		default:
+			return nil, errInvalidKey
+		}
+	}
+
+	if len(seg) > 0 {
+		return nil, errInvalidKey
+	}
+
+	return path, nil
+}
+
+// scanPrefix returns the key prefix that covers all keys located under path.
+func scanPrefix(path storage.Path) []byte {
+	return keyFor(path)
+}
+
+func appendPath(path storage.Path, key string) storage.Path {
+	cpy := make(storage.Path, len(path)+1)
+	copy(cpy, path)
+	cpy[len(path)] = key
+	return cpy
+}
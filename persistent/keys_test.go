@@ -0,0 +1,171 @@
+package persistent
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	badgerv1 "github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/v2"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util/test"
+)
+
+func TestKeyEncoding(t *testing.T) {
+
+	paths := []storage.Path{
+		{},
+		{"a"},
+		{"a", ""},
+		{"a", "b"},
+		{"a", "b%2Fc"},
+		{"a", "b/c"},
+		{"a\x00"},
+		{"a\x00b"},
+		{"a\x01"},
+		{"ab"},
+		{"b"},
+		{"\xff"},
+	}
+
+	var keys [][]byte
+
+	for _, path := range paths {
+		key := keyFor(path)
+		result, err := keyPath(key)
+		if err != nil {
+			t.Fatalf("%q: %v", path, err)
+		}
+		if len(result) != len(path) || (len(path) > 0 && !result.Equal(path)) {
+			t.Fatalf("%q: round trip produced %q", path, result)
+		}
+		keys = append(keys, key)
+	}
+
+	sorted := sort.SliceIsSorted(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+
+	if !sorted {
+		t.Fatal("expected keys to preserve path order")
+	}
+
+	if bytes.HasPrefix(keyFor(storage.Path{"ab"}), scanPrefix(storage.Path{"a"})) {
+		t.Fatal("expected scan prefix to exclude sibling with common prefix")
+	}
+
+	for _, key := range [][]byte{[]byte("/a/b"), append(keyFor(storage.Path{"a"}), 'b'), append(keyFor(nil), 0x00, 0x02)} {
+		if _, err := keyPath(key); err == nil {
+			t.Fatalf("expected error for key %q", key)
+		}
+	}
+}
+
+func TestSpecialCharacters(t *testing.T) {
+	test.WithTempFS(map[string]string{}, func(dir string) {
+		ctx := context.Background()
+		s := newTestStore(t, dir, []storage.Path{{"users"}})
+		defer s.Close()
+
+		value := map[string]interface{}{
+			"a/b":  "x",
+			"a%2F": "y",
+			"a":    "z",
+		}
+
+		if err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/users"), value); err != nil {
+			t.Fatal(err)
+		}
+
+		val, err := storage.ReadOne(ctx, s, storage.MustParsePath("/users"))
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(value, val) {
+			t.Fatalf("expected %v but got %v", value, val)
+		}
+
+		val, err = storage.ReadOne(ctx, s, storage.Path{"users", "a/b"})
+		if err != nil {
+			t.Fatal(err)
+		} else if val != "x" {
+			t.Fatalf("expected x but got %v", val)
+		}
+	})
+}
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	test.WithTempFS(map[string]string{}, func(dir string) {
+
+		// Legacy keys were written by versions of the store built on badger
+		// v1.6 so the directory has to be upgraded before it is opened.
+		src := filepath.Join(dir, "v1")
+
+		db, err := badgerv1.Open(badgerv1.DefaultOptions(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.Update(func(txn *badgerv1.Txn) error {
+			if err := txn.Set([]byte("/users/alice"), []byte(`["admin"]`)); err != nil {
+				return err
+			}
+			if err := txn.Set([]byte("/users/bob"), []byte(`["employee"]`)); err != nil {
+				return err
+			}
+			return txn.Set([]byte("/users/a%2Fb%25c"), []byte(`["customer"]`))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		partitions := []storage.Path{{"users"}}
+		dst := filepath.Join(dir, "v2")
+
+		if err := Upgrade(src, Options{Dir: dst, Partitions: partitions}); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		s := newTestStore(t, dst, partitions)
+		defer s.Close()
+
+		val, err := storage.ReadOne(ctx, s, storage.MustParsePath("/users"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exp := map[string]interface{}{
+			"alice": []interface{}{"admin"},
+			"bob":   []interface{}{"employee"},
+			"a/b%c": []interface{}{"customer"},
+		}
+
+		if !reflect.DeepEqual(exp, val) {
+			t.Fatalf("expected %v but got %v", exp, val)
+		}
+
+		val, err = storage.ReadOne(ctx, s, storage.Path{"users", "a/b%c"})
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(exp["a/b%c"], val) {
+			t.Fatalf("expected %v but got %v", exp["a/b%c"], val)
+		}
+
+		err = s.db.View(func(txn *badger.Txn) error {
+			if keys := scanKeys(txn, legacyPrefix); len(keys) != 0 {
+				t.Fatalf("expected legacy keys to be removed but got %q", keys)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
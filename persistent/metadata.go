@@ -0,0 +1,197 @@
+package persistent
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+// formatVersion identifies the layout of keys in the store. Directories
+// written before the version was recorded used path strings as data keys.
+const formatVersion = 1
+
+// metadataPrefix is the key prefix that store metadata is stored under.
+var metadataPrefix = []byte("metadata/")
+
+var versionKey = metadataKey("version")
+var codecKey = metadataKey("codec")
+
+// legacyPrefix is the prefix of data keys written before the key encoding
+// was introduced.
+var legacyPrefix = []byte("/")
+
+func errUnsupportedVersion(v int) *storage.Error {
+	return &storage.Error{Code: storage.InternalErr, Message: fmt.Sprintf("unsupported format version %d (expected %d or lower)", v, formatVersion)}
+}
+
+func metadataKey(name string) []byte {
+	return append(append([]byte{}, metadataPrefix...), name...)
+}
+
+// init checks the metadata recorded in the store, migrates data written by
+// earlier versions, and selects the codec for stored values.
+func (s *Store) init(codec Codec) error {
+
+	if err := s.initVersion(); err != nil {
+		return err
+	}
+
+	return s.initCodec(codec)
+}
+
+func (s *Store) initVersion() error {
+
+	var version int
+
+	value, ok, err := s.getMetadata(versionKey)
+	if err != nil {
+		return err
+	} else if ok {
+		version, err = strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version == formatVersion {
+		return nil
+	} else if version > formatVersion {
+		return errUnsupportedVersion(version)
+	}
+
+	if err := s.migrateLegacyKeys(); err != nil {
+		return err
+	}
+
+	return s.putMetadata(versionKey, strconv.Itoa(formatVersion))
+}
+
+// initCodec selects the codec for stored values. Stores that contain data but
+// no recorded codec were written before codecs were introduced and use JSON.
+func (s *Store) initCodec(codec Codec) error {
+
+	recorded, ok, err := s.getMetadata(codecKey)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		empty, err := s.empty()
+		if err != nil {
+			return err
+		}
+		recorded = JSON.Name()
+		if empty && codec != nil {
+			recorded = codec.Name()
+		}
+		if err := s.putMetadata(codecKey, recorded); err != nil {
+			return err
+		}
+	}
+
+	if codec == nil {
+		codec, ok = codecs[recorded]
+		if !ok {
+			return errUnknownCodec(recorded)
+		}
+	} else if codec.Name() != recorded {
+		return errCodecMismatch(codec.Name(), recorded)
+	}
+
+	s.codec = codec
+	return nil
+}
+
+// empty returns true if the store does not contain any data.
+func (s *Store) empty() (empty bool, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: dataPrefix})
+		defer it.Close()
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	return empty, err
+}
+
+func (s *Store) getMetadata(key []byte) (value string, ok bool, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			return err
+		}
+		bs, err := item.ValueCopy(nil)
+		value, ok = string(bs), true
+		return err
+	})
+	return value, ok, err
+}
+
+func (s *Store) putMetadata(key []byte, value string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, []byte(value))
+	})
+}
+
+// migrateLegacyKeys rewrites data keys that were written as path strings
+// into the current key encoding. Keys that could not be parsed by earlier
+// versions of the store are reported as errors.
+func (s *Store) migrateLegacyKeys() error {
+
+	wb := s.db.NewWriteBatch()
+	var n int
+
+	err := s.db.View(func(txn *badger.Txn) error {
+
+		it := txn.NewIterator(badger.IteratorOptions{
+			Prefix:         legacyPrefix,
+			PrefetchValues: true,
+			PrefetchSize:   100,
+		})
+
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			// legacy keys were built with storage.Path.String, which escapes
+			// each segment.
+			path, ok := storage.ParsePathEscaped(string(item.Key()))
+			if !ok {
+				return errInvalidKey
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := wb.Set(keyFor(path), val); err != nil {
+				return err
+			}
+			if err := wb.Delete(item.KeyCopy(nil)); err != nil {
+				return err
+			}
+			n++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		wb.Cancel()
+		return err
+	}
+
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	if n > 0 && s.logger != nil {
+		s.logger.Infof("Migrated %d keys to format version %d.", n, formatVersion)
+	}
+
+	return nil
+}
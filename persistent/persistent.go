@@ -1,223 +1,581 @@
 package persistent
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"log"
+	"strconv"
 	"sync"
+	"time"
 
-	"github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/v2"
 	"github.com/open-policy-agent/opa/storage"
-	"github.com/open-policy-agent/opa/util"
 )
 
-// TODO(tsandall): support multi-level partitioning for use cases like k8s
-// TODO(tsandall): check that writes don't escape from the defined partitions
-// TODO(tsandall): how to deal w/ overwrite? need to delete existing keys...
-// TODO(tsandall): assert that partitions are disjoint
-// TODO(tsandall): wrap badger errors before returning from exported functions
-
-var errNotFound = &storage.Error{Code: storage.NotFoundErr}
-var errInvalidNonLeafType = &storage.Error{Code: storage.InvalidPatchErr, Message: "invalid non-leaf node type"}
-var errInvalidNonLeafKey = &storage.Error{Code: storage.InvalidPatchErr, Message: "invalid non-leaf node key"}
 var errInvalidPatch = &storage.Error{Code: storage.InvalidPatchErr}
 var errInvalidKey = &storage.Error{Code: storage.InternalErr, Message: "invalid key"}
-var errUnknownPartition = &storage.Error{Code: storage.InternalErr, Message: "unknown partition"}
+var errMissingDir = &storage.Error{Code: storage.InternalErr, Message: "directory must be set"}
+var errInMemoryDir = &storage.Error{Code: storage.InternalErr, Message: "directory must not be set for in-memory stores"}
+var errClosed = &storage.Error{Code: storage.InternalErr, Message: "store is closed"}
+var errStaleTxn = &storage.Error{Code: storage.InvalidTransactionErr, Message: "stale transaction"}
+var errRestoring = &storage.Error{Code: storage.InternalErr, Message: "store is being restored"}
+var errRootRemove = &storage.Error{Code: storage.InvalidPatchErr, Message: "root cannot be removed"}
+
+// Options contains parameters that configure the persistent store.
+type Options struct {
+	// Dir is the directory that badger stores data in. Dir must not be set
+	// if InMemory is true.
+	Dir string
+
+	// InMemory, if true, keeps all data in memory instead of in a directory.
+	// Data is lost when the store is closed.
+	InMemory bool
+
+	// Partitions are the paths that documents are split under. Each document
+	// directly under a partition is stored in a separate key. Partitions may
+	// contain wildcard segments ("*") to split documents at multiple levels.
+	Partitions []storage.Path
+
+	// Badger, if set, is invoked with the default badger options and returns
+	// the options used to open the database. This can be used to tune badger.
+	Badger func(badger.Options) badger.Options
+
+	// Logger, if set, receives badger's log messages.
+	Logger badger.Logger
+
+	// CacheSize is the maximum number of decoded values to cache for point
+	// reads. Values returned by reads must not be modified when the cache is
+	// enabled. Zero disables the cache.
+	CacheSize int
+
+	// Codec, if set, serializes stored values. Defaults to the codec recorded
+	// in the store or JSON for new stores. An error is returned if the codec
+	// does not match the one recorded in the store.
+	Codec Codec
+
+	// MaxAttempts is the maximum number of times Txn runs a write transaction
+	// that fails to commit due to a conflict. Defaults to 10.
+	MaxAttempts int
+
+	// RetryBackoff is the delay before Txn retries a transaction for the first
+	// time. The delay doubles on each subsequent retry up to one second.
+	// Defaults to 10ms.
+	RetryBackoff time.Duration
+
+	// EncryptionKey, if set, enables encryption at rest. The key must be 16,
+	// 24 or 32 bytes to select AES-128, AES-192 or AES-256. Stores must be
+	// opened with the key they were written with (see RotateEncryptionKey).
+	EncryptionKey []byte
+
+	// EncryptionKeyRotation is how often badger generates a new data key to
+	// encrypt stored values with. Data keys are encrypted with EncryptionKey.
+	// Defaults to 10 days.
+	EncryptionKeyRotation time.Duration
+}
+
+// New returns a store backed by badger that is opened with opts. An error is
+// returned if the options are invalid or if badger cannot be opened.
+func New(opts Options) (*Store, error) {
+
+	bopts, err := badgerOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := badger.Open(bopts)
+	if err != nil {
+		return nil, wrapEncryptionError(err)
+	}
+
+	s := &Store{
+		db:         db,
+		partitions: opts.Partitions,
+		logger:     bopts.Logger,
+		next:       1,
+		triggers:   map[*handle]storage.TriggerConfig{},
+		retry:      newRetryPolicy(opts.MaxAttempts, opts.RetryBackoff),
+	}
+
+	if opts.CacheSize > 0 {
+		s.cache = newValueCache(opts.CacheSize)
+	}
 
-func New(dir string, partitions []storage.Path) storage.Store {
-	db, err := badger.Open(badger.DefaultOptions(dir))
-	check(err)
-	return &store{db: db, partitions: partitions, next: 1}
+	if err := s.init(opts.Codec); err != nil {
+		db.Close()
+		return nil, wrapError(err)
+	}
+
+	return s, nil
 }
 
-type store struct {
+// badgerOptions validates opts and returns the options to open badger with.
+func badgerOptions(opts Options) (badger.Options, error) {
+
+	if opts.InMemory {
+		if opts.Dir != "" {
+			return badger.Options{}, errInMemoryDir
+		}
+	} else if opts.Dir == "" {
+		return badger.Options{}, errMissingDir
+	}
+
+	if err := validatePartitions(opts.Partitions); err != nil {
+		return badger.Options{}, err
+	}
+
+	bopts := badger.DefaultOptions(opts.Dir).WithInMemory(opts.InMemory)
+
+	if opts.Badger != nil {
+		bopts = opts.Badger(bopts)
+	}
+
+	if opts.Logger != nil {
+		bopts = bopts.WithLogger(opts.Logger)
+	}
+
+	if len(opts.EncryptionKey) > 0 {
+		if err := checkEncryptionKey(opts.EncryptionKey); err != nil {
+			return badger.Options{}, err
+		}
+		bopts = bopts.WithEncryptionKey(opts.EncryptionKey)
+		if opts.EncryptionKeyRotation > 0 {
+			bopts = bopts.WithEncryptionKeyRotationDuration(opts.EncryptionKeyRotation)
+		}
+	}
+
+	return bopts, nil
+}
+
+// Store implements the storage.Store interface on top of badger. Stores must
+// be closed once they are no longer needed.
+type Store struct {
 	db         *badger.DB
 	partitions []storage.Path
+	logger     badger.Logger
+	codec      Codec
+	cache      *valueCache
+	retry      *retryPolicy
 	mu         sync.Mutex
 	next       uint64
-
-	storage.PolicyNotSupported
-	storage.TriggersNotSupported
+	closed     bool
+	restoring  bool
+	rmu        sync.Mutex     // held while restoring
+	active     sync.WaitGroup // in-flight transactions
+	cmu        sync.Mutex     // serializes commits of write transactions
+	triggers   map[*handle]storage.TriggerConfig
 }
 
 type transaction struct {
 	id         uint64
 	underlying *badger.Txn
+	write      bool
+	load       bool // commit when the transaction is too big
+	partial    bool // the current write was partially committed by a flush
+	stale      bool
+	context    *storage.Context
+	data       []storage.DataEvent   // data written in the transaction
+	policies   []storage.PolicyEvent // policies written in the transaction
+	flushed    int                   // data events committed by flushes
+	pflushed   int                   // policy events committed by flushes
+	written    [][]byte              // keys written in the transaction (if caching)
 }
 
 func (txn *transaction) ID() uint64 {
 	return txn.id
 }
 
-func (s *store) NewTransaction(_ context.Context, params ...storage.TransactionParams) (storage.Transaction, error) {
+func (s *Store) NewTransaction(_ context.Context, params ...storage.TransactionParams) (storage.Transaction, error) {
 
 	var write bool
+	var context *storage.Context
 
 	if len(params) > 0 {
 		write = params[0].Write
+		context = params[0].Context
+	}
+
+	return s.newTransaction(write, false, context)
+}
+
+// NewLoadTransaction returns a write transaction for loading large amounts of
+// data. Unlike other transactions, load transactions are not atomic: when the
+// writes buffered in the transaction exceed badger's transaction size limit,
+// they are committed and the transaction continues. Aborting the transaction
+// only discards writes that have not been committed yet. Triggers are invoked
+// once when the transaction is committed, or, if the transaction is aborted,
+// with the writes that were committed before it was aborted. Like other
+// transactions, load transactions only hold on to written values if triggers
+// are registered.
+func (s *Store) NewLoadTransaction(_ context.Context, params ...storage.TransactionParams) (storage.Transaction, error) {
+
+	var context *storage.Context
+
+	if len(params) > 0 {
+		context = params[0].Context
+	}
+
+	return s.newTransaction(true, true, context)
+}
+
+func (s *Store) newTransaction(write, load bool, context *storage.Context) (*transaction, error) {
+
+	id, err := s.acquire()
+	if err != nil {
+		return nil, err
 	}
 
 	txn := s.db.NewTransaction(write)
 
+	return &transaction{underlying: txn, id: id, write: write, load: load, context: context}, nil
+}
+
+// acquire registers an in-flight operation and returns its ID. Close waits for
+// in-flight operations to finish.
+func (s *Store) acquire() (uint64, error) {
 	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, errClosed
+	}
+	if s.restoring {
+		return 0, errRestoring
+	}
 	id := s.next
 	s.next++
-	s.mu.Unlock()
+	s.active.Add(1)
+	return id, nil
+}
+
+// Commit commits the transaction. If the transaction is a write transaction,
+// registered triggers are invoked after the commit succeeds. Commits are
+// serialized so that triggers observe changes in commit order. During the
+// callbacks, reads on the transaction observe the committed state.
+func (s *Store) Commit(ctx context.Context, txn storage.Transaction) error {
+	t, err := s.underlying(txn)
+	if err != nil {
+		return err
+	}
+
+	defer s.finish(t)
+
+	// badger does not discard transactions without pending writes on commit
+	// and transactions that are not discarded hold back badger's read
+	// watermark.
+	utxn := t.underlying
+	defer utxn.Discard()
+
+	if !t.write {
+		return wrapError(utxn.Commit())
+	}
+
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+
+	if err := utxn.Commit(); err != nil {
+		return wrapError(err)
+	}
 
-	return &transaction{underlying: txn, id: id}, nil
+	if s.cache != nil {
+		s.cache.invalidate(t.written)
+	}
+
+	t.underlying = s.db.NewTransaction(false)
+	defer t.underlying.Discard()
+
+	s.runOnCommitTriggers(ctx, t, storage.TriggerEvent{
+		Data:    t.data,
+		Policy:  t.policies,
+		Context: t.context,
+	})
+
+	return nil
+}
+
+func (s *Store) Abort(ctx context.Context, txn storage.Transaction) {
+	t, err := s.underlying(txn)
+	if err != nil {
+		return
+	}
+
+	defer s.finish(t)
+
+	t.underlying.Discard()
+
+	// writes committed by load transactions are not undone so triggers must
+	// still be notified of them.
+	if t.flushed == 0 && t.pflushed == 0 {
+		return
+	}
+
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+
+	t.underlying = s.db.NewTransaction(false)
+	defer t.underlying.Discard()
+
+	s.runOnCommitTriggers(ctx, t, storage.TriggerEvent{
+		Data:    t.data[:t.flushed],
+		Policy:  t.policies[:t.pflushed],
+		Context: t.context,
+	})
+}
+
+func (s *Store) underlying(txn storage.Transaction) (*transaction, error) {
+	t, ok := txn.(*transaction)
+	if !ok {
+		return nil, &storage.Error{Code: storage.InvalidTransactionErr, Message: fmt.Sprintf("unexpected transaction type %T", txn)}
+	}
+	if t.stale {
+		return nil, errStaleTxn
+	}
+	return t, nil
 }
 
-func (s *store) Commit(_ context.Context, txn storage.Transaction) error {
-	underlying := txn.(*transaction).underlying
-	return underlying.Commit()
+func (s *Store) finish(txn *transaction) {
+	txn.stale = true
+	s.active.Done()
 }
 
-func (s *store) Abort(_ context.Context, txn storage.Transaction) {
-	u := txn.(*transaction).underlying
-	u.Discard()
+// Close waits for in-flight transactions to finish and then closes badger.
+// New transactions are rejected once Close has been called.
+func (s *Store) Close() error {
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	s.active.Wait()
+
+	// wait for restores to finish.
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	return wrapError(s.db.Close())
 }
 
 func errValueUnpartionable(p storage.Path) *storage.Error {
 	return &storage.Error{Code: storage.InternalErr, Message: fmt.Sprintf("value cannot be partitioned: %v", p)}
 }
 
-func (s *store) Read(_ context.Context, txn storage.Transaction, path storage.Path) (result interface{}, err error) {
+func errDocumentNotFound(p storage.Path) *storage.Error {
+	return &storage.Error{Code: storage.NotFoundErr, Message: fmt.Sprintf("%v: document does not exist", p)}
+}
 
-	// fmt.Println("read:", path)
+func errUnroutable(p storage.Path) *storage.Error {
+	return &storage.Error{Code: storage.InternalErr, Message: fmt.Sprintf("%v: key cannot be routed", p)}
+}
 
-	key, tail, scan, err := s.partitionRead(path)
+func errInvalidPartition(p storage.Path, msg string) *storage.Error {
+	return &storage.Error{Code: storage.InternalErr, Message: fmt.Sprintf("invalid partition %v: %v", p, msg)}
+}
 
-	// fmt.Println("  --> key:", string(key), "tail:", tail)
-	// defer func() {
-	// 	fmt.Println("  --> result:", result, "err:", err)
-	// }()
+func errPartitionsOverlap(a, b storage.Path) *storage.Error {
+	return &storage.Error{Code: storage.InternalErr, Message: fmt.Sprintf("partitions overlap: %v and %v", a, b)}
+}
+
+// validatePartitions returns an error if any partition is empty or if two
+// partitions overlap. Partitions overlap if one refers to a prefix of the other
+// (after accounting for wildcards) because reads and writes could be routed to
+// either.
+func validatePartitions(partitions []storage.Path) error {
+
+	for i, a := range partitions {
+
+		if len(a) == 0 {
+			return errInvalidPartition(a, "path must not be empty")
+		}
 
+		for _, seg := range a {
+			if seg == "" {
+				return errInvalidPartition(a, "path segments must not be empty")
+			}
+		}
+
+		for _, b := range partitions[:i] {
+			if a.Equal(b) {
+				return errInvalidPartition(a, "duplicate")
+			}
+			if partitionsOverlap(a, b) {
+				return errPartitionsOverlap(b, a)
+			}
+		}
+	}
+
+	return nil
+}
+
+func partitionsOverlap(a, b storage.Path) bool {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] && a[i] != wildcard && b[i] != wildcard {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Store) Read(_ context.Context, txn storage.Transaction, path storage.Path) (result interface{}, err error) {
+	t, err := s.underlying(txn)
 	if err != nil {
 		return nil, err
 	}
+	result, err = s.read(t, path)
+	return result, wrapError(err)
+}
+
+func (s *Store) read(t *transaction, path storage.Path) (result interface{}, err error) {
+
+	txn := t.underlying
+
+	// fmt.Println("read:", path)
 
-	u := txn.(*transaction).underlying
+	key, tail, scan := s.partitionRead(path)
+
+	// fmt.Println("  --> key:", string(key), "tail:", tail)
+	// defer func() {
+	// 	fmt.Println("  --> result:", result, "err:", err)
+	// }()
 
 	if scan {
-		return s.readScan(u, path)
+		return s.readScan(txn, path)
 	}
 
-	item, err := u.Get(key)
+	item, err := txn.Get(key)
 	if err != nil {
 		if badger.ErrKeyNotFound == err {
-			return nil, errNotFound
+			return nil, errDocumentNotFound(path)
 		}
 		return nil, err
 	}
 
 	var x interface{}
 
-	err = item.Value(func(bs []byte) error {
-		return util.NewJSONDecoder(bytes.NewReader(bs)).Decode(&x)
-	})
+	// write transactions may observe uncommitted values so they bypass the
+	// cache.
+	if s.cache != nil && !t.write {
+		x, err = s.decodeCached(item)
+	} else {
+		x, err = s.decode(item)
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	return ptr(x, tail)
+	return ptr(x, path, len(path)-len(tail))
 }
 
-func (s *store) readScan(txn *badger.Txn, path storage.Path) (interface{}, error) {
-
-	var prefix []byte
-
-	if len(path) == 0 {
-		prefix = []byte("/")
-	} else {
-		prefix = []byte(path.String() + "/") // append / to exclude substring matches
-	}
-
-	it := txn.NewIterator(badger.IteratorOptions{
-		Prefix: prefix,
-	})
-
-	defer it.Close()
+// readScan materializes the documents stored under path. OPA's evaluator
+// requires fully materialized values so memory used by a read grows with the
+// size of the scanned subtree.
+func (s *Store) readScan(txn *badger.Txn, path storage.Path) (interface{}, error) {
 
 	result := map[string]interface{}{}
 
-	for it.Rewind(); it.Valid(); it.Next() {
-		item := it.Item()
-		subpath, ok := storage.ParsePath(string(item.Key()))
-		if !ok {
-			return nil, errInvalidKey
-		}
+	err := s.scan(txn, path, func(subpath storage.Path, val interface{}) error {
 
 		subpath = subpath[len(path):]
+		node := result
 
-		err := item.Value(func(bs []byte) error {
-
-			var val interface{}
-
-			if err := json.Unmarshal(bs, &val); err != nil {
-				return err
+		for i := 0; i < len(subpath)-1; i++ {
+			k := subpath[i]
+			next, ok := node[k]
+			if !ok {
+				next = map[string]interface{}{}
+				node[k] = next
 			}
 
-			node := result
-
-			for i := 0; i < len(subpath)-1; i++ {
-				k := subpath[i]
-				next, ok := node[k]
-				if !ok {
-					next = map[string]interface{}{}
-					node[k] = next
-				}
+			// NOTE(tsandall): this assertion cannot fail because the hierarchy
+			// is constructed here--a panic indicates a bug in this code.
+			node = next.(map[string]interface{})
+		}
 
-				// NOTE(tsandall): this assertion cannot fail because the hierarchy
-				// is constructed here--a panic indicates a bug in this code.
-				node = next.(map[string]interface{})
-			}
+		node[subpath[len(subpath)-1]] = val
+		return nil
+	})
 
-			node[subpath[len(subpath)-1]] = val
-			return nil
-		})
-		if err != nil {
-			return nil, err
-		}
+	if err != nil {
+		return nil, err
 	}
 
 	return result, nil
 }
 
-func (s *store) Write(_ context.Context, txn storage.Transaction, op storage.PatchOp, path storage.Path, value interface{}) error {
-	u := txn.(*transaction).underlying
+// decode returns the value stored in item. All reads (point reads, scans, and
+// read-modify-write) decode values here so that the same stored value always
+// produces the same result, e.g., numbers are always json.Number.
+func (s *Store) decode(item *badger.Item) (interface{}, error) {
+	var x interface{}
+	err := item.Value(func(bs []byte) error {
+		var err error
+		x, err = s.codec.Unmarshal(bs)
+		return err
+	})
+	return x, err
+}
+
+func (s *Store) Write(_ context.Context, txn storage.Transaction, op storage.PatchOp, path storage.Path, value interface{}) error {
+	t, err := s.underlying(txn)
+	if err != nil {
+		return err
+	}
 	switch op {
-	case storage.AddOp:
-		return s.writeAdd(u, path, value)
-	case storage.ReplaceOp:
-		return errors.New("not implemented: write: replace")
-	case storage.RemoveOp:
-		return errors.New("not implemented: write: remove")
+	case storage.AddOp, storage.ReplaceOp, storage.RemoveOp:
 	default:
 		return errInvalidPatch
 	}
+	t.partial = false
+	err = s.write(t, op, path, value)
+	if err != nil && !t.partial {
+		return wrapError(err)
+	}
+	if s.hasTriggers() {
+		t.data = append(t.data, storage.DataEvent{
+			Path:    path,
+			Data:    value,
+			Removed: op == storage.RemoveOp,
+		})
+	}
+	// part of the write was committed by a flush so its event is reported
+	// even if the transaction is aborted.
+	if t.partial {
+		t.flushed = len(t.data)
+	}
+	return wrapError(err)
 }
 
-func (s *store) writeAdd(txn *badger.Txn, path storage.Path, value interface{}) error {
+func (s *Store) write(t *transaction, op storage.PatchOp, path storage.Path, value interface{}) error {
+
+	txn := t.underlying
 
-	ops, err := s.partitionWriteAdd(txn, path, value)
+	ops, err := s.partitionWrite(txn, op, path, value)
 	if err != nil {
 		return err
 	}
 
 	for _, op := range ops {
-		if op.delete {
-			return errors.New("not implemented: write: add: deletion")
+		if err := s.checkKey(op.key); err != nil {
+			return err
 		}
+	}
 
-		bs, err := json.Marshal(op.val)
-		if err != nil {
-			return err
+	for i, op := range ops {
+		err := s.apply(t, op)
+		if err == badger.ErrTxnTooBig && t.load {
+			if err := s.flush(t); err != nil {
+				return err
+			}
+			if i > 0 {
+				t.partial = true
+			}
+			err = s.apply(t, op)
 		}
-		err = txn.Set(op.key, bs)
 		if err != nil {
 			return err
 		}
@@ -226,51 +584,104 @@ func (s *store) writeAdd(txn *badger.Txn, path storage.Path, value interface{})
 	return nil
 }
 
+func (s *Store) apply(t *transaction, op partitionOp) error {
+
+	if s.cache != nil {
+		t.written = append(t.written, op.key)
+	}
+
+	if op.delete {
+		return t.underlying.Delete(op.key)
+	}
+
+	bs, err := s.codec.Marshal(op.val)
+	if err != nil {
+		return err
+	}
+
+	return t.underlying.Set(op.key, bs)
+}
+
+// flush commits the writes buffered in the load transaction t and continues
+// the transaction in a new badger transaction.
+func (s *Store) flush(t *transaction) error {
+
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+
+	if err := t.underlying.Commit(); err != nil {
+		return err
+	}
+
+	if s.cache != nil {
+		s.cache.invalidate(t.written)
+		t.written = nil
+	}
+
+	t.flushed, t.pflushed = len(t.data), len(t.policies)
+	t.underlying = s.db.NewTransaction(true)
+	return nil
+}
+
 type partitionOp struct {
 	key    []byte
 	delete bool
 	val    interface{}
 }
 
-func (s *store) partitionWriteAdd(txn *badger.Txn, path storage.Path, value interface{}) ([]partitionOp, error) {
+func (s *Store) partitionWrite(txn *badger.Txn, op storage.PatchOp, path storage.Path, value interface{}) ([]partitionOp, error) {
 
-	for _, p := range s.partitions {
-		if p.HasPrefix(path) {
-			return s.partitionWriteAddMultiple(txn, path, value)
-		}
+	if index, ok := s.keyIndex(path); ok {
+		return s.partitionWriteOne(txn, op, path, value, index)
 	}
 
-	for _, p := range s.partitions {
-		if path.HasPrefix(p) {
-			return s.partitionWriteAddOne(txn, path, value, len(p)+1)
+	return s.partitionWriteMultiple(txn, op, path, value)
+}
+
+func (s *Store) partitionWriteMultiple(txn *badger.Txn, op storage.PatchOp, path storage.Path, value interface{}) ([]partitionOp, error) {
+
+	if op == storage.RemoveOp {
+		if len(path) == 0 {
+			return nil, errRootRemove
 		}
+	} else if _, ok := value.(map[string]interface{}); !ok {
+		return nil, errValueUnpartionable(path)
 	}
 
-	return nil, errUnknownPartition
-}
+	existing := scanKeys(txn, scanPrefix(path))
 
-func (s *store) partitionWriteAddMultiple(txn *badger.Txn, path storage.Path, value interface{}) ([]partitionOp, error) {
+	// documents above partitions only exist if keys are stored under them.
+	// The root always exists.
+	if op != storage.AddOp && len(path) > 0 && len(existing) == 0 {
+		return nil, errDocumentNotFound(path)
+	}
 
 	var result []partitionOp
+	keys := map[string]struct{}{}
+
+	if op != storage.RemoveOp {
+		err := s.splitValue(path, value, func(key storage.Path, val interface{}) {
+			bs := keyFor(key)
+			keys[string(bs)] = struct{}{}
+			result = append(result, partitionOp{
+				key: bs,
+				val: val,
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	for _, p := range s.partitions {
-		if p.HasPrefix(path) {
-			x, err := ptr(value, p[len(path):])
-			if err != nil {
-				return nil, err
-			} else if x == nil {
-				continue
-			}
-			obj, ok := x.(map[string]interface{})
-			if !ok {
-				return nil, errValueUnpartionable(p)
-			}
-			for k, v := range obj {
-				result = append(result, partitionOp{
-					key: []byte(p.String() + "/" + k),
-					val: v,
-				})
-			}
+	// the new value overwrites the document so existing keys that are not
+	// present in it must be removed otherwise they would be visible to
+	// subsequent reads. In the case of remove, all keys are removed.
+	for _, key := range existing {
+		if _, ok := keys[string(key)]; !ok {
+			result = append(result, partitionOp{
+				key:    key,
+				delete: true,
+			})
 		}
 	}
 
@@ -278,105 +689,296 @@ func (s *store) partitionWriteAddMultiple(txn *badger.Txn, path storage.Path, va
 
 }
 
-func (s *store) partitionWriteAddOne(txn *badger.Txn, path storage.Path, value interface{}, index int) ([]partitionOp, error) {
+// checkKey returns an error if key does not refer to a document that reads
+// would be routed to.
+func (s *Store) checkKey(key []byte) error {
+	path, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	if index, ok := s.keyIndex(path); !ok || index != len(path) {
+		return errUnroutable(path)
+	}
+	return nil
+}
+
+// splitValue invokes f for each key/value pair obtained by splitting x,
+// located at path, across the partitions.
+func (s *Store) splitValue(path storage.Path, x interface{}, f func(storage.Path, interface{})) error {
+
+	obj, ok := x.(map[string]interface{})
+	if !ok {
+		return errValueUnpartionable(path)
+	}
+
+	for k, v := range obj {
+		child := appendPath(path, k)
+		if s.partitioned(child) {
+			if err := s.splitValue(child, v, f); err != nil {
+				return err
+			}
+		} else {
+			f(child, v)
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) partitionWriteOne(txn *badger.Txn, op storage.PatchOp, path storage.Path, value interface{}, index int) ([]partitionOp, error) {
 
 	// exact match - return one operation
 	if len(path) == index {
+		key := keyFor(path)
+		if op != storage.AddOp {
+			if _, err := txn.Get(key); err != nil {
+				if err == badger.ErrKeyNotFound {
+					return nil, errDocumentNotFound(path)
+				}
+				return nil, err
+			}
+		}
 		return []partitionOp{
 			{
-				key: []byte(path.String()),
-				val: value,
+				key:    key,
+				delete: op == storage.RemoveOp,
+				val:    value,
 			},
 		}, nil
 	}
 
 	// prefix match - return one operation but perform read-modify-write
-	key := []byte(path[:index].String())
+	key := keyFor(path[:index])
 	item, err := txn.Get(key)
 	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, errDocumentNotFound(path)
+		}
 		return nil, err
 	}
 
-	var modified interface{}
+	modified, err := s.decode(item)
+	if err != nil {
+		return nil, err
+	}
 
-	err = item.Value(func(bs []byte) error {
+	modified, err = patch(modified, op, path, index, value)
+	if err != nil {
+		return nil, err
+	}
 
-		if err := util.Unmarshal(bs, &modified); err != nil {
-			return err
+	return []partitionOp{
+		{
+			key: key,
+			val: modified,
+		},
+	}, nil
+}
+
+func (s *Store) partitionRead(path storage.Path) ([]byte, storage.Path, bool) {
+
+	if index, ok := s.keyIndex(path); ok {
+		return keyFor(path[:index]), path[index:], false
+	}
+
+	return nil, nil, true
+}
+
+// keyIndex returns the length of the path prefix identifying the key that
+// stores the document at path. Documents under a partition are stored in
+// keys one level below the partition; documents outside of partitions are
+// stored whole in keys one level below the nearest partition ancestor. If
+// path refers to a partition or one of its ancestors, the document is spread
+// across multiple keys and keyIndex returns false.
+func (s *Store) keyIndex(path storage.Path) (int, bool) {
+	for i := 1; i <= len(path); i++ {
+		if !s.partitioned(path[:i]) {
+			return i, true
 		}
+	}
+	return 0, false
+}
 
-		node := modified
+// partitioned returns true if path refers to a partition or one of its
+// ancestors.
+func (s *Store) partitioned(path storage.Path) bool {
+	for _, p := range s.partitions {
+		if prefixMatch(p, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcard is the partition path segment that matches any key. Wildcards
+// allow documents to be split across multiple levels, e.g., the partition
+// /kubernetes/*/* stores each object under /kubernetes/<kind>/<namespace>/<name>.
+const wildcard = "*"
 
-		for i := index; i < len(path)-1; i++ {
-			obj, ok := node.(map[string]interface{})
+// prefixMatch returns true if path refers to partition p or one of its
+// ancestors.
+func prefixMatch(p, path storage.Path) bool {
+	if len(path) > len(p) {
+		return false
+	}
+	return segmentsMatch(p[:len(path)], path)
+}
+
+func segmentsMatch(pattern, path storage.Path) bool {
+	for i := range pattern {
+		if pattern[i] != wildcard && pattern[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ptr returns the document located at path[index:] inside of x.
+func ptr(x interface{}, path storage.Path, index int) (interface{}, error) {
+
+	result := x
+
+	for i := index; i < len(path); i++ {
+		switch node := result.(type) {
+		case map[string]interface{}:
+			var ok bool
+			result, ok = node[path[i]]
 			if !ok {
-				return errInvalidNonLeafType
+				return nil, errDocumentNotFound(path)
 			}
-			node, ok = obj[path[i]]
-			if !ok {
-				return errInvalidNonLeafKey
+		case []interface{}:
+			pos, err := arrayIndex(node, path, i)
+			if err != nil {
+				return nil, err
 			}
+			result = node[pos]
+		default:
+			return nil, errDocumentNotFound(path)
 		}
+	}
 
-		obj, ok := node.(map[string]interface{})
-		if !ok {
-			return errInvalidNonLeafType
-		}
+	return result, nil
+}
 
-		obj[path[len(path)-1]] = value
+// wrapError converts errors returned by badger into storage errors so that
+// callers can rely on the storage error codes. The original message is kept
+// for debugging.
+func wrapError(err error) error {
 
+	if err == nil {
 		return nil
-	})
+	}
 
-	if err != nil {
-		return nil, err
+	if _, ok := err.(*storage.Error); ok {
+		return err
 	}
 
-	return []partitionOp{
-		{
-			key: key,
-			val: modified,
-		},
-	}, nil
-}
+	var code string
 
-func (s *store) partitionRead(path storage.Path) ([]byte, storage.Path, bool, error) {
+	switch err {
+	case badger.ErrKeyNotFound:
+		code = storage.NotFoundErr
+	case badger.ErrConflict:
+		code = storage.WriteConflictErr
+	case badger.ErrReadOnlyTxn, badger.ErrDiscardedTxn:
+		code = storage.InvalidTransactionErr
+	default:
+		code = storage.InternalErr
+	}
 
-	for _, p := range s.partitions {
+	return &storage.Error{Code: code, Message: err.Error()}
+}
 
-		if p.HasPrefix(path) {
-			return nil, nil, true, nil
+// patch applies op to the document x at path[index:] and returns the result.
+// The document is modified in-place. The semantics match the inmem store:
+// all operations require the parent to exist and remove and replace
+// additionally require the target to exist.
+func patch(x interface{}, op storage.PatchOp, path storage.Path, index int, value interface{}) (interface{}, error) {
+
+	switch node := x.(type) {
+	case map[string]interface{}:
+		key := path[index]
+		if index == len(path)-1 {
+			if op != storage.AddOp {
+				if _, ok := node[key]; !ok {
+					return nil, errDocumentNotFound(path)
+				}
+			}
+			if op == storage.RemoveOp {
+				delete(node, key)
+			} else {
+				node[key] = value
+			}
+			return node, nil
 		}
-
-		if path.HasPrefix(p) {
-			return []byte(path[:len(p)+1].String()), path[len(p)+1:], false, nil
+		child, ok := node[key]
+		if !ok {
+			return nil, errDocumentNotFound(path)
 		}
+		child, err := patch(child, op, path, index+1, value)
+		if err != nil {
+			return nil, err
+		}
+		node[key] = child
+		return node, nil
 
+	case []interface{}:
+		if index == len(path)-1 && path[index] == "-" {
+			if op != storage.AddOp {
+				return nil, &storage.Error{Code: storage.InvalidPatchErr, Message: fmt.Sprintf("%v: invalid patch path", path)}
+			}
+			return append(node, value), nil
+		}
+		pos, err := arrayIndex(node, path, index)
+		if err != nil {
+			return nil, err
+		}
+		if index == len(path)-1 {
+			switch op {
+			case storage.AddOp:
+				node = append(node, nil)
+				copy(node[pos+1:], node[pos:])
+			case storage.RemoveOp:
+				return append(node[:pos], node[pos+1:]...), nil
+			}
+			node[pos] = value
+			return node, nil
+		}
+		child, err := patch(node[pos], op, path, index+1, value)
+		if err != nil {
+			return nil, err
+		}
+		node[pos] = child
+		return node, nil
 	}
 
-	return nil, nil, false, errUnknownPartition
+	return nil, errDocumentNotFound(path)
 }
 
-func check(err error) {
+func arrayIndex(arr []interface{}, path storage.Path, index int) (int, error) {
+	pos, err := strconv.Atoi(path[index])
 	if err != nil {
-		log.Fatal(err)
+		return 0, &storage.Error{Code: storage.NotFoundErr, Message: fmt.Sprintf("%v: array index must be integer", path)}
+	}
+	if pos < 0 || pos >= len(arr) {
+		return 0, &storage.Error{Code: storage.NotFoundErr, Message: fmt.Sprintf("%v: array index out of range", path)}
 	}
+	return pos, nil
 }
 
-func ptr(x interface{}, path storage.Path) (interface{}, error) {
+func scanKeys(txn *badger.Txn, prefix []byte) [][]byte {
 
-	result := x
+	it := txn.NewIterator(badger.IteratorOptions{
+		Prefix: prefix,
+	})
 
-	for _, k := range path {
-		obj, ok := result.(map[string]interface{})
-		if !ok {
-			return nil, nil
-		}
-		result, ok = obj[k]
-		if !ok {
-			return nil, nil
-		}
+	defer it.Close()
+
+	var keys [][]byte
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
 	}
 
-	return result, nil
+	return keys
 }
@@ -2,85 +2,959 @@ package persistent
 
 import (
 	"context"
+	"fmt"
+	"io/ioutil"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/dgraph-io/badger/v2"
 	"github.com/open-policy-agent/opa/storage"
 
 	"github.com/open-policy-agent/opa/util/test"
 )
 
+func newTestStore(t *testing.T, dir string, partitions []storage.Path) *Store {
+	t.Helper()
+	s, err := New(Options{Dir: dir, Partitions: partitions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newInMemoryStore(t *testing.T, partitions []storage.Path) *Store {
+	t.Helper()
+	s, err := New(Options{InMemory: true, Partitions: partitions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// dataKeys returns the paths of all data keys in the store.
+func dataKeys(t *testing.T, s *Store) []string {
+	t.Helper()
+	var keys []string
+	err := s.db.View(func(txn *badger.Txn) error {
+		for _, key := range scanKeys(txn, dataPrefix) {
+			path, err := keyPath(key)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, path.String())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
 func TestScan(t *testing.T) {
-	test.WithTempFS(map[string]string{}, func(dir string) {
-		store := NewStore(dir, []storage.Path{{"test"}, {"ignore"}})
-		ctx := context.Background()
-		storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
-			err := store.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/"), map[string]interface{}{
-				"test": map[string]interface{}{
+	store := newInMemoryStore(t, []storage.Path{{"test"}, {"ignore"}})
+	defer store.Close()
+	ctx := context.Background()
+	storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+		err := store.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/"), map[string]interface{}{
+			"test": map[string]interface{}{
+				"1": "a",
+				"2": "b",
+				"3": "c",
+			},
+			"ignore": map[string]interface{}{
+				"x": "y",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, err := store.Read(ctx, txn, storage.MustParsePath("/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := map[string]interface{}{
+			"ignore": map[string]interface{}{
+				"x": "y",
+			},
+			"test": map[string]interface{}{
+				"1": "a",
+				"2": "b",
+				"3": "c",
+			},
+		}
+		if !reflect.DeepEqual(exp, val) {
+			t.Fatalf("expected %v but got %v", exp, val)
+		}
+		return nil
+	})
+}
+
+func TestOverride(t *testing.T) {
+	store := newInMemoryStore(t, []storage.Path{{"test"}})
+	defer store.Close()
+	ctx := context.Background()
+	storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+		err := store.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/test/foo"), map[string]interface{}{
+			"bar": map[string]interface{}{
+				"baz": "qux",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/test/foo/bar/corge"), "override")
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, err := store.Read(ctx, txn, storage.MustParsePath("/test/foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := map[string]interface{}{
+			"bar": map[string]interface{}{
+				"baz":   "qux",
+				"corge": "override",
+			},
+		}
+		if !reflect.DeepEqual(exp, val) {
+			t.Fatalf("expected %v but got %v", exp, val)
+		}
+		return nil
+	})
+}
+
+func TestReplace(t *testing.T) {
+
+	tests := []struct {
+		note     string
+		path     string
+		value    interface{}
+		readPath string
+		exp      interface{}
+		notFound bool
+	}{
+		{
+			note:     "above partition",
+			path:     "/",
+			value:    map[string]interface{}{"test": map[string]interface{}{"3": "c"}},
+			readPath: "/test",
+			exp:      map[string]interface{}{"3": "c"},
+		},
+		{
+			note:     "partition root",
+			path:     "/test",
+			value:    map[string]interface{}{"2": "x", "3": "c"},
+			readPath: "/test",
+			exp:      map[string]interface{}{"2": "x", "3": "c"},
+		},
+		{
+			note:     "partition root missing",
+			path:     "/foo/bar",
+			value:    map[string]interface{}{"x": "y"},
+			notFound: true,
+		},
+		{
+			note:     "above partition missing",
+			path:     "/foo",
+			value:    map[string]interface{}{"bar": map[string]interface{}{"x": "y"}},
+			notFound: true,
+		},
+		{
+			note:     "partition key",
+			path:     "/test/1",
+			value:    "x",
+			readPath: "/test",
+			exp:      map[string]interface{}{"1": "x", "2": map[string]interface{}{"a": []interface{}{"b"}}},
+		},
+		{
+			note:     "partition key missing",
+			path:     "/test/3",
+			value:    "x",
+			notFound: true,
+		},
+		{
+			note:     "inside value",
+			path:     "/test/2/a/0",
+			value:    "x",
+			readPath: "/test/2",
+			exp:      map[string]interface{}{"a": []interface{}{"x"}},
+		},
+		{
+			note:     "inside value missing",
+			path:     "/test/2/b",
+			value:    "x",
+			notFound: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			store := newInMemoryStore(t, []storage.Path{{"test"}, {"foo", "bar"}})
+			defer store.Close()
+			ctx := context.Background()
+			err := storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+				return store.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/test"), map[string]interface{}{
 					"1": "a",
-					"2": "b",
-					"3": "c",
-				},
-				"ignore": map[string]interface{}{
-					"x": "y",
-				},
+					"2": map[string]interface{}{"a": []interface{}{"b"}},
+				})
 			})
 			if err != nil {
 				t.Fatal(err)
 			}
-			val, err := store.Read(ctx, txn, storage.MustParsePath("/"))
-			if err != nil {
+			err = storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+				return store.Write(ctx, txn, storage.ReplaceOp, storage.MustParsePath(tc.path), tc.value)
+			})
+			if tc.notFound {
+				if !storage.IsNotFound(err) {
+					t.Fatalf("expected not found error but got %v", err)
+				}
+				return
+			} else if err != nil {
 				t.Fatal(err)
 			}
-			exp := map[string]interface{}{
-				"ignore": map[string]interface{}{
-					"x": "y",
-				},
-				"test": map[string]interface{}{
-					"1": "a",
-					"2": "b",
-					"3": "c",
-				},
+			val, err := storage.ReadOne(ctx, store, storage.MustParsePath(tc.readPath))
+			if err != nil {
+				t.Fatal(err)
 			}
-			if !reflect.DeepEqual(exp, val) {
-				t.Fatalf("expected %v but got %v", exp, val)
+			if !reflect.DeepEqual(tc.exp, val) {
+				t.Fatalf("expected %v but got %v", tc.exp, val)
 			}
-			return nil
 		})
-	})
+	}
 }
 
-func TestOverride(t *testing.T) {
-	test.WithTempFS(map[string]string{}, func(dir string) {
-		store := NewStore(dir, []storage.Path{{"test"}})
-		ctx := context.Background()
-		storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
-			err := store.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/test/foo"), map[string]interface{}{
-				"bar": map[string]interface{}{
-					"baz": "qux",
-				},
+func TestRemove(t *testing.T) {
+
+	tests := []struct {
+		note     string
+		path     string
+		readPath string
+		exp      interface{}
+		errCode  string
+	}{
+		{
+			note:    "root",
+			path:    "/",
+			errCode: storage.InvalidPatchErr,
+		},
+		{
+			note:     "above partition",
+			path:     "/foo",
+			readPath: "/",
+			exp:      map[string]interface{}{"test": map[string]interface{}{"1": "a", "2": map[string]interface{}{"a": []interface{}{"b"}}}},
+		},
+		{
+			note:     "partition root",
+			path:     "/test",
+			readPath: "/test",
+			exp:      map[string]interface{}{},
+		},
+		{
+			note:    "partition root missing",
+			path:    "/baz",
+			errCode: storage.NotFoundErr,
+		},
+		{
+			note:     "partition key",
+			path:     "/test/1",
+			readPath: "/test",
+			exp:      map[string]interface{}{"2": map[string]interface{}{"a": []interface{}{"b"}}},
+		},
+		{
+			note:    "partition key missing",
+			path:    "/test/3",
+			errCode: storage.NotFoundErr,
+		},
+		{
+			note:     "inside value",
+			path:     "/test/2/a/0",
+			readPath: "/test/2",
+			exp:      map[string]interface{}{"a": []interface{}{}},
+		},
+		{
+			note:    "inside value missing",
+			path:    "/test/2/b",
+			errCode: storage.NotFoundErr,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			store := newInMemoryStore(t, []storage.Path{{"test"}, {"foo", "bar"}, {"baz"}})
+			defer store.Close()
+			ctx := context.Background()
+			err := storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+				return store.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/"), map[string]interface{}{
+					"test": map[string]interface{}{
+						"1": "a",
+						"2": map[string]interface{}{"a": []interface{}{"b"}},
+					},
+					"foo": map[string]interface{}{
+						"bar": map[string]interface{}{"x": "y"},
+					},
+				})
 			})
 			if err != nil {
 				t.Fatal(err)
 			}
-			err = store.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/test/foo/bar/corge"), "override")
+			err = storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+				return store.Write(ctx, txn, storage.RemoveOp, storage.MustParsePath(tc.path), nil)
+			})
+			if tc.errCode != "" {
+				if serr, ok := err.(*storage.Error); !ok || serr.Code != tc.errCode {
+					t.Fatalf("expected %v error but got %v", tc.errCode, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			val, err := storage.ReadOne(ctx, store, storage.MustParsePath(tc.readPath))
 			if err != nil {
 				t.Fatal(err)
 			}
-			val, err := store.Read(ctx, txn, storage.MustParsePath("/test/foo"))
+			if !reflect.DeepEqual(tc.exp, val) {
+				t.Fatalf("expected %v but got %v", tc.exp, val)
+			}
+		})
+	}
+}
+
+func TestAddOverwritesPartition(t *testing.T) {
+	store := newInMemoryStore(t, []storage.Path{{"test"}, {"foo", "bar"}})
+	defer store.Close()
+	ctx := context.Background()
+
+	writes := []struct {
+		path  string
+		value interface{}
+	}{
+		{"/", map[string]interface{}{"test": map[string]interface{}{"1": "a", "2": "b"}, "foo": map[string]interface{}{"bar": map[string]interface{}{"x": "y"}}}},
+		{"/test", map[string]interface{}{"2": "c", "3": "d"}},
+		{"/foo", map[string]interface{}{"bar": map[string]interface{}{"z": "w"}}},
+		{"/test/4", "e"},
+	}
+
+	for _, w := range writes {
+		err := storage.WriteOne(ctx, store, storage.AddOp, storage.MustParsePath(w.path), w.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	val, err := storage.ReadOne(ctx, store, storage.MustParsePath("/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]interface{}{
+		"test": map[string]interface{}{"2": "c", "3": "d", "4": "e"},
+		"foo":  map[string]interface{}{"bar": map[string]interface{}{"z": "w"}},
+	}
+
+	if !reflect.DeepEqual(exp, val) {
+		t.Fatalf("expected %v but got %v", exp, val)
+	}
+
+	// writes within the same transaction must observe the overwrite
+	err = storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+		if err := store.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/test"), map[string]interface{}{"5": "f"}); err != nil {
+			return err
+		}
+		val, err := store.Read(ctx, txn, storage.MustParsePath("/test"))
+		if err != nil {
+			return err
+		}
+		exp := map[string]interface{}{"5": "f"}
+		if !reflect.DeepEqual(exp, val) {
+			t.Fatalf("expected %v but got %v", exp, val)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteStaleKeys(t *testing.T) {
+
+	// Keys written with a different partition layout cannot be routed and
+	// writes that would touch them are rejected.
+	tests := []struct {
+		note  string
+		key   storage.Path
+		op    storage.PatchOp
+		path  string
+		value interface{}
+	}{
+		{"below key", storage.Path{"test", "a", "b"}, storage.ReplaceOp, "/test", map[string]interface{}{"a": "x"}},
+		{"at partition", storage.Path{"foo", "bar"}, storage.RemoveOp, "/foo", nil},
+		{"root", storage.Path{"test"}, storage.AddOp, "/", map[string]interface{}{}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			store := newInMemoryStore(t, []storage.Path{{"test"}, {"foo", "bar"}})
+			defer store.Close()
+			ctx := context.Background()
+
+			err := store.db.Update(func(txn *badger.Txn) error {
+				return txn.Set(keyFor(tc.key), []byte(`"stale"`))
+			})
 			if err != nil {
 				t.Fatal(err)
 			}
-			exp := map[string]interface{}{
-				"bar": map[string]interface{}{
-					"baz":   "qux",
-					"corge": "override",
-				},
+
+			err = storage.WriteOne(ctx, store, tc.op, storage.MustParsePath(tc.path), tc.value)
+			if err == nil || !strings.Contains(err.Error(), "key cannot be routed") {
+				t.Fatalf("expected unroutable key error but got %v", err)
+			}
+
+			if keys, exp := dataKeys(t, store), []string{tc.key.String()}; !reflect.DeepEqual(keys, exp) {
+				t.Fatalf("expected keys %v but got %v", exp, keys)
+			}
+		})
+	}
+}
+
+func TestMultiLevelPartition(t *testing.T) {
+	s := newInMemoryStore(t, []storage.Path{{"kubernetes", "*", "*"}})
+	defer s.Close()
+	ctx := context.Background()
+
+	err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/kubernetes"), map[string]interface{}{
+		"ingresses": map[string]interface{}{
+			"ns1": map[string]interface{}{
+				"a": map[string]interface{}{"host": "a.com"},
+				"b": map[string]interface{}{"host": "b.com"},
+			},
+			"ns2": map[string]interface{}{
+				"c": map[string]interface{}{"host": "c.com"},
+			},
+		},
+		"pods": map[string]interface{}{
+			"ns1": map[string]interface{}{
+				"d": map[string]interface{}{"image": "nginx"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.WriteOne(ctx, s, storage.ReplaceOp, storage.MustParsePath("/kubernetes/ingresses/ns1"), map[string]interface{}{
+		"e": map[string]interface{}{"host": "e.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/kubernetes/pods/ns1/d/image"), "redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := dataKeys(t, s)
+
+	expKeys := []string{
+		"/kubernetes/ingresses/ns1/e",
+		"/kubernetes/ingresses/ns2/c",
+		"/kubernetes/pods/ns1/d",
+	}
+
+	if !reflect.DeepEqual(expKeys, keys) {
+		t.Fatalf("expected keys %v but got %v", expKeys, keys)
+	}
+
+	reads := []struct {
+		path string
+		exp  interface{}
+	}{
+		{"/kubernetes/ingresses/ns1", map[string]interface{}{"e": map[string]interface{}{"host": "e.com"}}},
+		{"/kubernetes/ingresses/ns2/c/host", "c.com"},
+		{"/kubernetes/pods", map[string]interface{}{"ns1": map[string]interface{}{"d": map[string]interface{}{"image": "redis"}}}},
+	}
+
+	for _, r := range reads {
+		val, err := storage.ReadOne(ctx, s, storage.MustParsePath(r.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r.exp, val) {
+			t.Fatalf("%v: expected %v but got %v", r.path, r.exp, val)
+		}
+	}
+
+	err = storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/kubernetes/ingresses"), map[string]interface{}{
+		"ns3": "bad",
+	})
+	if err == nil {
+		t.Fatal("expected error for value that cannot be partitioned")
+	}
+}
+
+func TestValidatePartitions(t *testing.T) {
+
+	tests := []struct {
+		note       string
+		partitions []string
+		wantErr    bool
+	}{
+		{"disjoint", []string{"/a", "/b/c", "/b/d"}, false},
+		{"disjoint wildcards", []string{"/a/*/c", "/a/*/d"}, false},
+		{"empty", []string{"/"}, true},
+		{"duplicate", []string{"/a/b", "/a/b"}, true},
+		{"prefix", []string{"/a", "/a/b"}, true},
+		{"prefix reversed", []string{"/a/b", "/a"}, true},
+		{"wildcard prefix", []string{"/a/*", "/a/b/c"}, true},
+		{"wildcard same length", []string{"/a/b", "/a/*"}, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			var partitions []storage.Path
+			for _, s := range tc.partitions {
+				partitions = append(partitions, storage.MustParsePath(s))
+			}
+			err := validatePartitions(partitions)
+			if tc.wantErr && err == nil {
+				t.Fatal("expected error")
+			} else if !tc.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestUnpartitioned(t *testing.T) {
+	s := newInMemoryStore(t, []storage.Path{{"test"}, {"foo", "bar"}})
+	defer s.Close()
+	ctx := context.Background()
+
+	writes := []struct {
+		op    storage.PatchOp
+		path  string
+		value interface{}
+	}{
+		{storage.AddOp, "/", map[string]interface{}{
+			"test":   map[string]interface{}{"1": "a"},
+			"config": map[string]interface{}{"x": "y"},
+			"foo": map[string]interface{}{
+				"bar": map[string]interface{}{"2": "b"},
+				"baz": []interface{}{"c"},
+			},
+		}},
+		{storage.AddOp, "/config/z", "w"},
+		{storage.AddOp, "/feature_flags", map[string]interface{}{"enabled": true}},
+		{storage.ReplaceOp, "/foo/baz/0", "d"},
+		{storage.RemoveOp, "/config/x", nil},
+	}
+
+	for _, w := range writes {
+		err := storage.WriteOne(ctx, s, w.op, storage.MustParsePath(w.path), w.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := dataKeys(t, s)
+
+	expKeys := []string{"/config", "/feature_flags", "/foo/bar/2", "/foo/baz", "/test/1"}
+
+	if !reflect.DeepEqual(expKeys, keys) {
+		t.Fatalf("expected keys %v but got %v", expKeys, keys)
+	}
+
+	val, err := storage.ReadOne(ctx, s, storage.MustParsePath("/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]interface{}{
+		"test":          map[string]interface{}{"1": "a"},
+		"config":        map[string]interface{}{"z": "w"},
+		"feature_flags": map[string]interface{}{"enabled": true},
+		"foo": map[string]interface{}{
+			"bar": map[string]interface{}{"2": "b"},
+			"baz": []interface{}{"d"},
+		},
+	}
+
+	if !reflect.DeepEqual(exp, val) {
+		t.Fatalf("expected %v but got %v", exp, val)
+	}
+
+	_, err = storage.ReadOne(ctx, s, storage.MustParsePath("/missing"))
+	if !storage.IsNotFound(err) {
+		t.Fatalf("expected not found error but got %v", err)
+	}
+
+	err = storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/foo"), map[string]interface{}{"bar": "x"})
+	if err == nil {
+		t.Fatal("expected error for value that cannot be partitioned")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	test.WithTempFS(map[string]string{}, func(dir string) {
+		if _, err := New(Options{}); err == nil {
+			t.Fatal("expected error for missing directory")
+		}
+		if _, err := New(Options{Dir: dir, InMemory: true}); err == nil {
+			t.Fatal("expected error for directory with in-memory store")
+		}
+		if _, err := New(Options{Dir: dir, Partitions: []storage.Path{{"a"}, {"a", "b"}}}); err == nil {
+			t.Fatal("expected error for overlapping partitions")
+		}
+		s := newTestStore(t, dir, nil)
+		defer s.Close()
+		if _, err := New(Options{Dir: dir}); err == nil {
+			t.Fatal("expected error for locked directory")
+		}
+	})
+}
+
+func TestInMemory(t *testing.T) {
+	ctx := context.Background()
+
+	before, err := ioutil.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newInMemoryStore(t, []storage.Path{{"test"}})
+
+	if err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/test/foo"), "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := ioutil.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(before) != len(after) {
+		t.Fatalf("expected no files to be created but got %d files before and %d after", len(before), len(after))
+	}
+
+	s = newInMemoryStore(t, []storage.Path{{"test"}})
+	defer s.Close()
+
+	if _, err := storage.ReadOne(ctx, s, storage.MustParsePath("/test/foo")); !storage.IsNotFound(err) {
+		t.Fatalf("expected not found error but got: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	test.WithTempFS(map[string]string{}, func(dir string) {
+		ctx := context.Background()
+		s := newTestStore(t, dir, []storage.Path{{"test"}})
+
+		err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/test/foo"), "bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		txn, err := s.NewTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error)
+
+		go func() {
+			done <- s.Close()
+		}()
+
+		select {
+		case err := <-done:
+			t.Fatalf("expected close to wait for transaction but got %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		s.Abort(ctx, txn)
+
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.NewTransaction(ctx); err == nil {
+			t.Fatal("expected error after close")
+		}
+
+		s = newTestStore(t, dir, []storage.Path{{"test"}})
+		defer s.Close()
+
+		val, err := storage.ReadOne(ctx, s, storage.MustParsePath("/test/foo"))
+		if err != nil {
+			t.Fatal(err)
+		} else if val != "bar" {
+			t.Fatalf("expected bar but got %v", val)
+		}
+	})
+}
+
+func TestCommitDiscards(t *testing.T) {
+	ctx := context.Background()
+	s := newInMemoryStore(t, nil)
+	defer s.Close()
+
+	for _, params := range []storage.TransactionParams{{}, storage.WriteParams} {
+		txn, err := s.NewTransaction(ctx, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		utxn := txn.(*transaction).underlying
+
+		if err := s.Commit(ctx, txn); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := utxn.Get(keyFor(storage.Path{"a"})); err != badger.ErrDiscardedTxn {
+			t.Fatalf("expected transaction to be discarded (write: %v) but got: %v", params.Write, err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	test.WithTempFS(map[string]string{}, func(dir string) {
+		ctx := context.Background()
+		s, err := New(Options{
+			Dir:        dir,
+			Partitions: []storage.Path{{"test"}},
+			Badger: func(opts badger.Options) badger.Options {
+				return opts.WithMaxTableSize(1 << 16)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		err = storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/test/foo"), map[string]interface{}{"a": []interface{}{"b"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, path := range []string{"/test/bar", "/test/foo/b", "/test/foo/a/1", "/test/foo/a/0/x"} {
+			_, err = storage.ReadOne(ctx, s, storage.MustParsePath(path))
+			if !storage.IsNotFound(err) {
+				t.Fatalf("%v: expected not found error but got %v", path, err)
 			}
-			if !reflect.DeepEqual(exp, val) {
-				t.Fatalf("expected %v but got %v", exp, val)
+		}
+
+		txn1 := storage.NewTransactionOrDie(ctx, s, storage.WriteParams)
+		txn2 := storage.NewTransactionOrDie(ctx, s, storage.WriteParams)
+
+		if err := s.Write(ctx, txn1, storage.AddOp, storage.MustParsePath("/test/foo/x"), "y"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Write(ctx, txn2, storage.AddOp, storage.MustParsePath("/test/foo/z"), "w"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Commit(ctx, txn2); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Commit(ctx, txn1); !storage.IsWriteConflictError(err) {
+			t.Fatalf("expected write conflict error but got %v", err)
+		}
+		if err := s.Commit(ctx, txn1); !storage.IsInvalidTransaction(err) {
+			t.Fatalf("expected invalid transaction error but got %v", err)
+		}
+
+		txn := storage.NewTransactionOrDie(ctx, s)
+		err = s.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/test/bar"), "x")
+		if !storage.IsInvalidTransaction(err) {
+			t.Fatalf("expected invalid transaction error but got %v", err)
+		}
+		s.Abort(ctx, txn)
+
+		txn = storage.NewTransactionOrDie(ctx, s, storage.WriteParams)
+		defer s.Abort(ctx, txn)
+		err = nil
+		for i := 0; err == nil && i < 10000; i++ {
+			err = s.Write(ctx, txn, storage.AddOp, storage.MustParsePath(fmt.Sprintf("/test/%d", i)), "x")
+		}
+		if serr, ok := err.(*storage.Error); !ok || serr.Code != storage.InternalErr {
+			t.Fatalf("expected internal error but got %v", err)
+		}
+	})
+}
+
+func TestLoadTransaction(t *testing.T) {
+	test.WithTempFS(map[string]string{}, func(dir string) {
+		ctx := context.Background()
+		s, err := New(Options{
+			Dir:        dir,
+			Partitions: []storage.Path{{"test"}},
+			Badger: func(opts badger.Options) badger.Options {
+				return opts.WithMaxTableSize(1 << 16)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		const n = 10000
+		value := map[string]interface{}{}
+		for i := 0; i < n; i++ {
+			value[fmt.Sprint(i)] = "x"
+		}
+
+		txn, err := s.NewLoadTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/test"), value); err != nil {
+			t.Fatal(err)
+		}
+
+		// Writes committed when the transaction became too big are visible
+		// before the transaction is committed.
+		if keys := dataKeys(t, s); len(keys) == 0 || len(keys) == n {
+			t.Fatalf("expected partial load but got %d keys", len(keys))
+		}
+
+		if err := s.Commit(ctx, txn); err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := storage.ReadOne(ctx, s, storage.MustParsePath("/test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result, value) {
+			t.Fatal("expected loaded value to be read back")
+		}
+
+		// Aborting only discards writes that have not been committed.
+		txn, err = s.NewLoadTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Write(ctx, txn, storage.RemoveOp, storage.MustParsePath("/test"), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		s.Abort(ctx, txn)
+
+		if keys := dataKeys(t, s); len(keys) == 0 || len(keys) == n {
+			t.Fatalf("expected partial removal but got %d keys", len(keys))
+		}
+	})
+}
+
+func TestLoadTransactionEvents(t *testing.T) {
+	ctx := context.Background()
+	s := newInMemoryStore(t, []storage.Path{{"test"}})
+	defer s.Close()
+
+	load := func() *transaction {
+		t.Helper()
+		txn, err := s.NewLoadTransaction(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := s.Write(ctx, txn, storage.AddOp, storage.MustParsePath(fmt.Sprintf("/test/%d", i)), "x"); err != nil {
+				t.Fatal(err)
 			}
-			return nil
+		}
+		return txn.(*transaction)
+	}
+
+	// Values are not retained for triggers if none are registered.
+	txn := load()
+	if len(txn.data) != 0 {
+		t.Fatalf("expected no events but got %d", len(txn.data))
+	}
+	if err := s.Commit(ctx, txn); err != nil {
+		t.Fatal(err)
+	}
+
+	var events int
+
+	err := storage.Txn(ctx, s, storage.WriteParams, func(txn storage.Transaction) error {
+		_, err := s.Register(ctx, txn, storage.TriggerConfig{
+			OnCommit: func(_ context.Context, _ storage.Transaction, event storage.TriggerEvent) {
+				events += len(event.Data)
+			},
+		})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Commit(ctx, load()); err != nil {
+		t.Fatal(err)
+	}
+
+	if events != 1000 {
+		t.Fatalf("expected 1000 events but got %d", events)
+	}
+}
+
+func TestLoadTransactionAbortEvents(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(Options{
+		InMemory:   true,
+		Partitions: []storage.Path{{"test"}},
+		Badger: func(opts badger.Options) badger.Options {
+			return opts.WithMaxTableSize(1 << 16)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var events []storage.DataEvent
+
+	err = storage.Txn(ctx, s, storage.WriteParams, func(txn storage.Transaction) error {
+		_, err := s.Register(ctx, txn, storage.TriggerConfig{
+			OnCommit: func(_ context.Context, _ storage.Transaction, event storage.TriggerEvent) {
+				events = append(events, event.Data...)
+			},
 		})
+		return err
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := s.NewLoadTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write until the transaction becomes too big and is committed. Writes
+	// after that are discarded when the transaction is aborted.
+	for i := 0; len(dataKeys(t, s)) == 0; i++ {
+		if err := s.Write(ctx, txn, storage.AddOp, storage.MustParsePath(fmt.Sprintf("/test/%d", i)), "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.Abort(ctx, txn)
+
+	var paths []string
+	for _, event := range events {
+		paths = append(paths, event.Path.String())
+	}
+
+	sort.Strings(paths)
+
+	if keys := dataKeys(t, s); !reflect.DeepEqual(keys, paths) {
+		t.Fatalf("expected events for %v but got %v", keys, paths)
+	}
 }
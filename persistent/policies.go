@@ -0,0 +1,96 @@
+package persistent
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+// policyPrefix is the key prefix that policy modules are stored under. Data
+// keys begin with dataPrefix so the keyspaces do not overlap.
+var policyPrefix = []byte("policies/")
+
+var errPolicyReadTxn = &storage.Error{Code: storage.InvalidTransactionErr, Message: "policy write during read transaction"}
+
+func errPolicyNotFound(id string) *storage.Error {
+	return &storage.Error{Code: storage.NotFoundErr, Message: fmt.Sprintf("policy id %q", id)}
+}
+
+func policyKey(id string) []byte {
+	return append(append([]byte{}, policyPrefix...), id...)
+}
+
+// ListPolicies returns the IDs of all policies stored in the store.
+func (s *Store) ListPolicies(_ context.Context, txn storage.Transaction) ([]string, error) {
+	t, err := s.underlying(txn)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, key := range scanKeys(t.underlying, policyPrefix) {
+		ids = append(ids, string(key[len(policyPrefix):]))
+	}
+	return ids, nil
+}
+
+// GetPolicy returns the raw policy module identified by id.
+func (s *Store) GetPolicy(_ context.Context, txn storage.Transaction, id string) ([]byte, error) {
+	t, err := s.underlying(txn)
+	if err != nil {
+		return nil, err
+	}
+	item, err := t.underlying.Get(policyKey(id))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, errPolicyNotFound(id)
+		}
+		return nil, wrapError(err)
+	}
+	bs, err := item.ValueCopy(nil)
+	return bs, wrapError(err)
+}
+
+// UpsertPolicy inserts or updates the raw policy module identified by id.
+func (s *Store) UpsertPolicy(_ context.Context, txn storage.Transaction, id string, bs []byte) error {
+	t, err := s.underlying(txn)
+	if err != nil {
+		return err
+	}
+	if !t.write {
+		return errPolicyReadTxn
+	}
+	if err := t.underlying.Set(policyKey(id), bs); err != nil {
+		return wrapError(err)
+	}
+	if s.hasTriggers() {
+		t.policies = append(t.policies, storage.PolicyEvent{ID: id, Data: bs})
+	}
+	return nil
+}
+
+// DeletePolicy removes the policy module identified by id. A not found error is
+// returned if the policy does not exist.
+func (s *Store) DeletePolicy(_ context.Context, txn storage.Transaction, id string) error {
+	t, err := s.underlying(txn)
+	if err != nil {
+		return err
+	}
+	if !t.write {
+		return errPolicyReadTxn
+	}
+	if _, err := t.underlying.Get(policyKey(id)); err != nil {
+		if err == badger.ErrKeyNotFound {
+			return errPolicyNotFound(id)
+		}
+		return wrapError(err)
+	}
+	if err := t.underlying.Delete(policyKey(id)); err != nil {
+		return wrapError(err)
+	}
+	if s.hasTriggers() {
+		t.policies = append(t.policies, storage.PolicyEvent{ID: id, Removed: true})
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package persistent
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util/test"
+)
+
+func TestPolicies(t *testing.T) {
+	test.WithTempFS(map[string]string{}, func(dir string) {
+		ctx := context.Background()
+		s := newTestStore(t, dir, []storage.Path{{"test"}})
+
+		err := storage.Txn(ctx, s, storage.WriteParams, func(txn storage.Transaction) error {
+			if err := s.UpsertPolicy(ctx, txn, "a.rego", []byte("package a")); err != nil {
+				return err
+			}
+			if err := s.UpsertPolicy(ctx, txn, "b/c.rego", []byte("package b.c")); err != nil {
+				return err
+			}
+			return s.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/"), map[string]interface{}{
+				"test": map[string]interface{}{"x": "y"},
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = storage.Txn(ctx, s, storage.WriteParams, func(txn storage.Transaction) error {
+			return s.DeletePolicy(ctx, txn, "a.rego")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = storage.Txn(ctx, s, storage.WriteParams, func(txn storage.Transaction) error {
+			return s.DeletePolicy(ctx, txn, "missing.rego")
+		})
+		if !storage.IsNotFound(err) {
+			t.Fatalf("expected not found error but got %v", err)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		s = newTestStore(t, dir, []storage.Path{{"test"}})
+		defer s.Close()
+
+		txn := storage.NewTransactionOrDie(ctx, s)
+		defer s.Abort(ctx, txn)
+
+		ids, err := s.ListPolicies(ctx, txn)
+		if err != nil {
+			t.Fatal(err)
+		} else if exp := []string{"b/c.rego"}; !reflect.DeepEqual(exp, ids) {
+			t.Fatalf("expected %v but got %v", exp, ids)
+		}
+
+		bs, err := s.GetPolicy(ctx, txn, "b/c.rego")
+		if err != nil {
+			t.Fatal(err)
+		} else if string(bs) != "package b.c" {
+			t.Fatalf("unexpected policy: %s", bs)
+		}
+
+		if _, err := s.GetPolicy(ctx, txn, "a.rego"); !storage.IsNotFound(err) {
+			t.Fatalf("expected not found error but got %v", err)
+		}
+
+		if err := s.UpsertPolicy(ctx, txn, "d.rego", nil); !storage.IsInvalidTransaction(err) {
+			t.Fatalf("expected invalid transaction error but got %v", err)
+		}
+
+		val, err := s.Read(ctx, txn, storage.Path{})
+		if err != nil {
+			t.Fatal(err)
+		} else if exp := map[string]interface{}{"test": map[string]interface{}{"x": "y"}}; !reflect.DeepEqual(exp, val) {
+			t.Fatalf("expected %v but got %v", exp, val)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package persistent
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/open-policy-agent/opa/storage"
+)
+
+const (
+	defaultMaxAttempts  = 10
+	defaultRetryBackoff = 10 * time.Millisecond
+	maxRetryBackoff     = time.Second
+)
+
+// RetryStats contains counters for transactions run with Txn.
+type RetryStats struct {
+	Retries   uint64 // transactions re-run after a conflict
+	Exhausted uint64 // transactions that conflicted on every attempt
+}
+
+// RetryStats returns the counters for transactions run with Txn.
+func (s *Store) RetryStats() RetryStats {
+	return RetryStats{
+		Retries:   atomic.LoadUint64(&s.retry.retries),
+		Exhausted: atomic.LoadUint64(&s.retry.exhausted),
+	}
+}
+
+// Txn is like storage.Txn except that write transactions that fail to commit
+// due to a conflict with a concurrent transaction are re-run. Before each
+// retry Txn sleeps with exponential backoff. Since f may be invoked multiple
+// times it must not have side effects outside of the transaction. If all
+// attempts conflict or ctx is cancelled while waiting to retry, the last
+// conflict error is returned.
+func (s *Store) Txn(ctx context.Context, params storage.TransactionParams, f func(storage.Transaction) error) error {
+
+	backoff := s.retry.backoff
+
+	for attempt := 1; ; attempt++ {
+
+		err := storage.Txn(ctx, s, params, f)
+		if !params.Write || !storage.IsWriteConflictError(err) {
+			return err
+		}
+
+		if attempt >= s.retry.attempts {
+			atomic.AddUint64(&s.retry.exhausted, 1)
+			return err
+		}
+
+		// Jitter the delay so that conflicting writers do not retry in lockstep.
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+
+		atomic.AddUint64(&s.retry.retries, 1)
+
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+type retryPolicy struct {
+	attempts  int
+	backoff   time.Duration
+	retries   uint64
+	exhausted uint64
+}
+
+func newRetryPolicy(attempts int, backoff time.Duration) *retryPolicy {
+	if attempts <= 0 {
+		attempts = defaultMaxAttempts
+	}
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	return &retryPolicy{attempts: attempts, backoff: backoff}
+}
@@ -0,0 +1,76 @@
+package persistent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/storage"
+)
+
+func TestTxnRetry(t *testing.T) {
+	s, err := New(Options{InMemory: true, MaxAttempts: 3, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	path := storage.MustParsePath("/x")
+
+	err = storage.Txn(ctx, s, storage.WriteParams, func(txn storage.Transaction) error {
+		return s.Write(ctx, txn, storage.AddOp, path, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// update reads and rewrites x. If conflicts is positive, a concurrent
+	// transaction modifies x before the update commits.
+	update := func(conflicts *int) error {
+		return s.Txn(ctx, storage.WriteParams, func(txn storage.Transaction) error {
+			val, err := s.Read(ctx, txn, path)
+			if err != nil {
+				return err
+			}
+			if *conflicts > 0 {
+				*conflicts--
+				err := storage.Txn(ctx, s, storage.WriteParams, func(txn storage.Transaction) error {
+					return s.Write(ctx, txn, storage.ReplaceOp, path, "concurrent")
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return s.Write(ctx, txn, storage.ReplaceOp, path, val)
+		})
+	}
+
+	conflicts := 2
+	if err := update(&conflicts); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := s.RetryStats(); stats != (RetryStats{Retries: 2}) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	conflicts = 3
+	if err := update(&conflicts); !storage.IsWriteConflictError(err) {
+		t.Fatalf("expected write conflict error but got: %v", err)
+	}
+
+	if stats := s.RetryStats(); stats != (RetryStats{Retries: 4, Exhausted: 1}) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	conflicts = 1
+	if err := update(&conflicts); !storage.IsWriteConflictError(err) {
+		t.Fatalf("expected write conflict error but got: %v", err)
+	}
+
+	if stats := s.RetryStats(); stats != (RetryStats{Retries: 4, Exhausted: 1}) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
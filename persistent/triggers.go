@@ -0,0 +1,67 @@
+package persistent
+
+import (
+	"context"
+
+	"github.com/open-policy-agent/opa/storage"
+)
+
+var errTriggerReadTxn = &storage.Error{Code: storage.InvalidTransactionErr, Message: "triggers must be registered with a write transaction"}
+
+type handle struct {
+	store *Store
+}
+
+// Register adds a trigger that is invoked each time a write transaction is
+// committed. Triggers must be registered with a write transaction. Events are
+// only recorded while triggers are registered so triggers do not receive
+// writes made by transactions before the trigger was registered.
+func (s *Store) Register(_ context.Context, txn storage.Transaction, config storage.TriggerConfig) (storage.TriggerHandle, error) {
+	t, err := s.underlying(txn)
+	if err != nil {
+		return nil, err
+	}
+	if !t.write {
+		return nil, errTriggerReadTxn
+	}
+	h := &handle{store: s}
+	s.mu.Lock()
+	s.triggers[h] = config
+	s.mu.Unlock()
+	return h, nil
+}
+
+// Unregister removes the trigger. Triggers must be unregistered with a write
+// transaction.
+func (h *handle) Unregister(_ context.Context, txn storage.Transaction) {
+	t, err := h.store.underlying(txn)
+	if err != nil {
+		panic(err)
+	}
+	if !t.write {
+		panic(errTriggerReadTxn)
+	}
+	h.store.mu.Lock()
+	delete(h.store.triggers, h)
+	h.store.mu.Unlock()
+}
+
+// hasTriggers returns true if any triggers are registered. Transactions only
+// record events for triggers if this is true.
+func (s *Store) hasTriggers() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.triggers) > 0
+}
+
+func (s *Store) runOnCommitTriggers(ctx context.Context, txn storage.Transaction, event storage.TriggerEvent) {
+	s.mu.Lock()
+	configs := make([]storage.TriggerConfig, 0, len(s.triggers))
+	for _, config := range s.triggers {
+		configs = append(configs, config)
+	}
+	s.mu.Unlock()
+	for _, config := range configs {
+		config.OnCommit(ctx, txn, event)
+	}
+}
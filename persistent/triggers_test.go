@@ -0,0 +1,104 @@
+package persistent
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/storage"
+)
+
+func TestTriggers(t *testing.T) {
+	ctx := context.Background()
+	s := newInMemoryStore(t, []storage.Path{{"test"}})
+	defer s.Close()
+
+	var events []storage.TriggerEvent
+	var reads []interface{}
+
+	var h storage.TriggerHandle
+
+	err := storage.Txn(ctx, s, storage.WriteParams, func(txn storage.Transaction) error {
+		var err error
+		h, err = s.Register(ctx, txn, storage.TriggerConfig{
+			OnCommit: func(ctx context.Context, txn storage.Transaction, event storage.TriggerEvent) {
+				events = append(events, event)
+				val, err := s.Read(ctx, txn, storage.MustParsePath("/test"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				reads = append(reads, val)
+			},
+		})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txnCtx := storage.NewContext()
+	txn, err := s.NewTransaction(ctx, storage.TransactionParams{Write: true, Context: txnCtx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/test/a"), "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, txn, storage.RemoveOp, storage.MustParsePath("/test/a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, txn, storage.AddOp, storage.MustParsePath("/test/b"), "y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(ctx, txn); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []storage.TriggerEvent{
+		{}, // registration transaction
+		{
+			Data: []storage.DataEvent{
+				{Path: storage.MustParsePath("/test/a"), Data: "x"},
+				{Path: storage.MustParsePath("/test/a"), Removed: true},
+				{Path: storage.MustParsePath("/test/b"), Data: "y"},
+			},
+			Context: txnCtx,
+		},
+	}
+
+	if !reflect.DeepEqual(exp, events) {
+		t.Fatalf("expected %v but got %v", exp, events)
+	}
+
+	expReads := []interface{}{
+		map[string]interface{}{},
+		map[string]interface{}{"b": "y"},
+	}
+
+	if !reflect.DeepEqual(expReads, reads) {
+		t.Fatalf("expected reads %v but got %v", expReads, reads)
+	}
+
+	err = storage.Txn(ctx, s, storage.WriteParams, func(txn storage.Transaction) error {
+		h.Unregister(ctx, txn)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.WriteOne(ctx, s, storage.AddOp, storage.MustParsePath("/test/c"), "z"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected no events after unregister but got %d events", len(events))
+	}
+
+	txn = storage.NewTransactionOrDie(ctx, s)
+	defer s.Abort(ctx, txn)
+
+	if _, err := s.Register(ctx, txn, storage.TriggerConfig{}); !storage.IsInvalidTransaction(err) {
+		t.Fatalf("expected invalid transaction error but got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package persistent
+
+import (
+	badgerv1 "github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/v2"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+var errUpgradeInMemory = &storage.Error{Code: storage.InternalErr, Message: "cannot upgrade into an in-memory store"}
+var errUpgradeNotEmpty = &storage.Error{Code: storage.InternalErr, Message: "cannot upgrade into a directory that contains a store"}
+
+// Upgrade copies the store in src, which was written by a version of the
+// store built on badger v1.6, into a new store in opts.Dir. Badger v2 cannot
+// open directories written by badger v1.6 so these stores must be upgraded
+// before they can be opened with New. Keys are copied as they are and
+// converted to the current key format when the new store is opened, so opts
+// must contain the partitions that the store was written with. The store in
+// src is not modified and neither store may be open.
+func Upgrade(src string, opts Options) error {
+
+	if opts.InMemory {
+		return errUpgradeInMemory
+	}
+
+	bopts, err := badgerOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	old, err := badgerv1.Open(badgerv1.DefaultOptions(src).WithReadOnly(true).WithLogger(bopts.Logger))
+	if err != nil {
+		return wrapError(err)
+	}
+
+	defer old.Close()
+
+	db, err := badger.Open(bopts)
+	if err != nil {
+		return wrapEncryptionError(err)
+	}
+
+	n, err := copyV1(old, db)
+	if err != nil {
+		db.Close()
+		return wrapError(err)
+	}
+
+	if err := db.Close(); err != nil {
+		return wrapError(err)
+	}
+
+	bopts.Logger.Infof("Copied %d keys from %v.", n, src)
+
+	// Opening the store migrates the copied keys to the current format.
+	s, err := New(opts)
+	if err != nil {
+		return err
+	}
+
+	return wrapError(s.Close())
+}
+
+// copyV1 copies the latest version of each key in old into db. db must be
+// empty.
+func copyV1(old *badgerv1.DB, db *badger.DB) (int, error) {
+
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{})
+		defer it.Close()
+		it.Rewind()
+		if it.Valid() {
+			return errUpgradeNotEmpty
+		}
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	wb := db.NewWriteBatch()
+	var n int
+
+	err = old.View(func(txn *badgerv1.Txn) error {
+
+		it := txn.NewIterator(badgerv1.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+		})
+
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := wb.Set(item.KeyCopy(nil), val); err != nil {
+				return err
+			}
+			n++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		wb.Cancel()
+		return 0, err
+	}
+
+	return n, wb.Flush()
+}
@@ -0,0 +1,101 @@
+package persistent
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	badgerv1 "github.com/dgraph-io/badger"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/util/test"
+)
+
+func TestUpgrade(t *testing.T) {
+	test.WithTempFS(map[string]string{}, func(dir string) {
+
+		// Stores that recorded the format version before the upgrade to badger
+		// v2 already use the current key format.
+		src := filepath.Join(dir, "v1")
+
+		db, err := badgerv1.Open(badgerv1.DefaultOptions(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.Update(func(txn *badgerv1.Txn) error {
+			if err := txn.Set(versionKey, []byte("1")); err != nil {
+				return err
+			}
+			if err := txn.Set(codecKey, []byte("json")); err != nil {
+				return err
+			}
+			if err := txn.Set(policyKey("a.rego"), []byte("package a")); err != nil {
+				return err
+			}
+			return txn.Set(keyFor(storage.Path{"users", "alice"}), []byte(`"a"`))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		key := []byte("0123456789abcdef")
+		opts := Options{Dir: filepath.Join(dir, "v2"), Partitions: []storage.Path{{"users"}}, EncryptionKey: key}
+
+		if err := Upgrade(src, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := New(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		txn := storage.NewTransactionOrDie(ctx, s)
+
+		if val, err := s.Read(ctx, txn, storage.MustParsePath("/users/alice")); err != nil || val != "a" {
+			t.Fatalf("expected a but got %v: %v", val, err)
+		}
+
+		if bs, err := s.GetPolicy(ctx, txn, "a.rego"); err != nil || string(bs) != "package a" {
+			t.Fatalf("unexpected policy %q: %v", bs, err)
+		}
+
+		s.Abort(ctx, txn)
+
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			note string
+			opts Options
+			exp  string
+		}{
+			{
+				note: "not empty",
+				opts: opts,
+				exp:  "contains a store",
+			},
+			{
+				note: "in-memory",
+				opts: Options{InMemory: true},
+				exp:  "in-memory",
+			},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.note, func(t *testing.T) {
+				err := Upgrade(src, tc.opts)
+				if err == nil || !strings.Contains(err.Error(), tc.exp) {
+					t.Fatalf("expected error containing %q but got: %v", tc.exp, err)
+				}
+			})
+		}
+	})
+}